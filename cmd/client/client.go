@@ -0,0 +1,613 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/crypt"
+	"github.com/kdada/tinyvpn/pkg/dns"
+	"github.com/kdada/tinyvpn/pkg/firewall"
+	"github.com/kdada/tinyvpn/pkg/proto"
+	"github.com/kdada/tinyvpn/pkg/state"
+	"github.com/kdada/tinyvpn/pkg/tun"
+	"github.com/xtaci/kcp-go"
+)
+
+// States of client
+const (
+	stateDisconnected   state.State = "Disconnected"
+	stateConnecting     state.State = "Connecting"
+	stateAuthenticating state.State = "Authenticating"
+	stateConnected      state.State = "Connected"
+	stateReconnecting   state.State = "Reconnecting"
+	stateStopped        state.State = "Stopped"
+)
+
+// Events of client
+const (
+	eventConnect       state.Event = "Connect"
+	eventDialed        state.Event = "Dialed"
+	eventAuthenticated state.Event = "Authenticated"
+	eventFail          state.Event = "Fail"
+	eventDisconnect    state.Event = "Disconnect"
+	eventStop          state.Event = "Stop"
+)
+
+// Requests of control api which end the current tunnel
+var (
+	errReconnect  = errors.New("reconnection is requested")
+	errDisconnect = errors.New("disconnection is requested")
+)
+
+// machine is a state machine which is safe for concurrent use. Transitions
+// of client are shown as below:
+//     Disconnected   -Connect->       Connecting
+//     Connecting     -Dialed->        Authenticating
+//     Authenticating -Authenticated-> Connected
+//     Connecting     -Fail->          Reconnecting
+//     Authenticating -Fail->          Reconnecting
+//     Connected      -Fail->          Reconnecting
+//     Reconnecting   -Connect->       Connecting
+//     Connected      -Disconnect->    Disconnected
+//     Reconnecting   -Disconnect->    Disconnected
+//     any state      -Stop->          Stopped
+type machine struct {
+	lock sync.Mutex
+	base *state.BaseMachine
+}
+
+// newMachine creates the state machine of client
+func newMachine() *machine {
+	base := state.NewBaseMachine()
+	states := []state.State{stateDisconnected, stateConnecting, stateAuthenticating, stateConnected, stateReconnecting, stateStopped}
+	for _, s := range states {
+		base.AddStateHandler(&stateLogger{state.NewBaseHandler(s)})
+		if s != stateStopped {
+			base.AddTransition(eventStop, s, stateStopped)
+		}
+	}
+	base.AddTransition(eventConnect, stateDisconnected, stateConnecting)
+	base.AddTransition(eventDialed, stateConnecting, stateAuthenticating)
+	base.AddTransition(eventAuthenticated, stateAuthenticating, stateConnected)
+	base.AddTransition(eventFail, stateConnecting, stateReconnecting)
+	base.AddTransition(eventFail, stateAuthenticating, stateReconnecting)
+	base.AddTransition(eventFail, stateConnected, stateReconnecting)
+	base.AddTransition(eventConnect, stateReconnecting, stateConnecting)
+	base.AddTransition(eventDisconnect, stateConnected, stateDisconnected)
+	base.AddTransition(eventDisconnect, stateReconnecting, stateDisconnected)
+	base.Start(stateDisconnected, nil)
+	return &machine{base: base}
+}
+
+// trigger triggers an event
+func (m *machine) trigger(event state.Event, data interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.base.Trigger(event, data)
+}
+
+// state returns the current state
+func (m *machine) state() state.State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.base.State
+}
+
+// stateLogger logs transitions of client
+type stateLogger struct {
+	*state.BaseHandler
+}
+
+// EnterState logs the new state and the error which causes the transition
+func (h *stateLogger) EnterState(m state.Machine, event state.Event, data interface{}) error {
+	if err, ok := data.(error); ok {
+		log.Println("enter state", h.State(), "because of", err)
+	} else {
+		log.Println("enter state", h.State())
+	}
+	return nil
+}
+
+// fullTunnelRoutes cover all ipv4 addresses. They are more specific than
+// the default route, so the default route is not touched.
+var fullTunnelRoutes = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+}
+
+// client connects to server and keeps reconnecting after the tunnel failed.
+// Its tunnel device and routes are kept across reconnections.
+type client struct {
+	machine *machine
+	counter *counter
+	// server is the address of server
+	server string
+	// endpoint is the resolved address of server
+	endpoint *net.UDPAddr
+	// bypassed is the server ip routed via the original gateway in full
+	// tunnel mode
+	bypassed net.IP
+	// killSwitch is not nil if kill switch is enabled
+	killSwitch *firewall.KillSwitch
+	// stop is closed when client is stopping
+	stop chan struct{}
+	// reconnects and disconnects receive requests of control api
+	reconnects  chan struct{}
+	disconnects chan struct{}
+	// lock protects fields below
+	lock    sync.Mutex
+	device  *tun.Device
+	dns     dns.Manager
+	tunnel  *proto.Tunnel
+	push    *proto.PushConfig
+	lastErr error
+}
+
+// newClient creates a client
+func newClient() *client {
+	return &client{
+		machine:     newMachine(),
+		counter:     &counter{},
+		server:      cfg.Server,
+		stop:        make(chan struct{}),
+		reconnects:  make(chan struct{}, 1),
+		disconnects: make(chan struct{}, 1),
+	}
+}
+
+// run connects to server and reconnects after failures until client
+// stopped. After a disconnect request, it waits for a reconnect request.
+func (c *client) run() {
+	c.machine.trigger(eventConnect, nil)
+	attempt := 0
+	for {
+		connected, err := c.connect()
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		if connected {
+			attempt = 0
+		}
+		resume := true
+		switch err {
+		case errDisconnect:
+			attempt = 0
+			resume = c.idle(err)
+		case errReconnect:
+			attempt = 0
+			c.machine.trigger(eventFail, err)
+		default:
+			c.lock.Lock()
+			c.lastErr = err
+			c.lock.Unlock()
+			c.machine.trigger(eventFail, err)
+			delay := backoff(attempt, cfg.Reconnect.MinDelay.Duration, cfg.Reconnect.MaxDelay.Duration)
+			attempt++
+			log.Println("reconnect in", delay)
+			resume = c.wait(delay)
+		}
+		if !resume {
+			return
+		}
+		c.machine.trigger(eventConnect, nil)
+	}
+}
+
+// wait waits for delay before reconnecting. A reconnect request ends the
+// wait early, and a disconnect request makes client idle. It returns false
+// if client stopped.
+func (c *client) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-c.stop:
+		return false
+	case <-timer.C:
+		return true
+	case <-c.reconnects:
+		return true
+	case <-c.disconnects:
+		return c.idle(errDisconnect)
+	}
+}
+
+// idle closes the device, then waits for a reconnect request. Kill switch
+// is kept, so nothing leaks while disconnected. It returns false if client
+// stopped.
+func (c *client) idle(reason error) bool {
+	c.machine.trigger(eventDisconnect, reason)
+	c.close()
+	if c.killSwitch != nil {
+		// the device is gone, only traffic to server is allowed
+		if err := c.killSwitch.Enable(""); err != nil {
+			log.Println(err)
+		}
+	}
+	select {
+	case <-c.stop:
+		return false
+	case <-c.reconnects:
+	}
+	// drop the disconnect request made while idle
+	select {
+	case <-c.disconnects:
+	default:
+	}
+	return true
+}
+
+// reconnect requests client to reconnect, or to connect if it's
+// disconnected
+func (c *client) reconnect() error {
+	if err := c.requestable(); err != nil {
+		return err
+	}
+	request(c.reconnects)
+	return nil
+}
+
+// disconnect requests client to disconnect and wait for a reconnect request
+func (c *client) disconnect() error {
+	if err := c.requestable(); err != nil {
+		return err
+	}
+	if c.machine.state() == stateDisconnected {
+		return fmt.Errorf("client is disconnected")
+	}
+	request(c.disconnects)
+	return nil
+}
+
+// requestable returns an error if client can't handle requests now.
+// Requests are handled after connecting, so they are rejected while
+// connecting.
+func (c *client) requestable() error {
+	switch c.machine.state() {
+	case stateConnecting, stateAuthenticating:
+		return fmt.Errorf("client is connecting, try again later")
+	case stateStopped:
+		return fmt.Errorf("client is stopped")
+	}
+	return nil
+}
+
+// request sends a request without blocking. Requests not handled yet are
+// merged.
+func request(requests chan struct{}) {
+	select {
+	case requests <- struct{}{}:
+	default:
+	}
+}
+
+// connect connects to server and transfers packets until the tunnel failed
+// or client stopped. It returns true if the tunnel was connected.
+func (c *client) connect() (bool, error) {
+	block, err := crypt.NewBlockCrypt(cfg.Transport.Crypt, cfg.Transport.Key)
+	if err != nil {
+		return false, err
+	}
+	conn, err := kcp.DialWithOptions(c.server, block, cfg.Transport.KCP.DataShards, cfg.Transport.KCP.ParityShards)
+	if err != nil {
+		return false, err
+	}
+	cfg.Transport.KCP.Apply(conn)
+	c.machine.trigger(eventDialed, nil)
+	var preferred net.IP
+	c.lock.Lock()
+	if c.device != nil {
+		preferred = c.device.SrcIP
+	}
+	c.lock.Unlock()
+	secureConn, result, err := authenticate(conn, preferred)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	log.Println("assigned address", result.Address.String(), "gateway", result.Gateway.String())
+	push, err := receiveConfig(secureConn)
+	if err == nil {
+		err = c.setup(result, push)
+	}
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	tunnel := proto.NewTunnel("tunnel", secureConn)
+	tunnel.Timeout = cfg.Tunnel.Timeout.Duration
+	tunnel.IdleTimeout = cfg.Tunnel.IdleTimeout.Duration
+	tunnel.Handle(proto.TypeConfig, func(message proto.DataSaver) error {
+		log.Println("config updated")
+		return c.configure(message.(*proto.PushConfig))
+	})
+	c.lock.Lock()
+	c.tunnel = tunnel
+	device := c.device
+	c.lock.Unlock()
+	c.machine.trigger(eventAuthenticated, nil)
+	tunnel.StartKeepalive(cfg.Tunnel.Keepalive.Duration)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.receive(tunnel, device)
+	}()
+	select {
+	case err = <-done:
+	case <-c.stop:
+		tunnel.Disconnect("client exited")
+		err = <-done
+	case <-c.reconnects:
+		tunnel.Disconnect("client is reconnecting")
+		<-done
+		err = errReconnect
+	case <-c.disconnects:
+		tunnel.Disconnect("client disconnected")
+		<-done
+		err = errDisconnect
+	}
+	c.lock.Lock()
+	c.tunnel = nil
+	c.lock.Unlock()
+	tunnel.Close()
+	return true, err
+}
+
+// setup creates the tunnel device and applies config. The device is kept
+// if its address is not changed.
+func (c *client) setup(result *proto.AuthResult, push *proto.PushConfig) error {
+	c.lock.Lock()
+	device := c.device
+	c.lock.Unlock()
+	if device == nil || !device.SrcIP.Equal(result.Address) || !device.DestIP.Equal(result.Gateway) {
+		if device != nil {
+			log.Println("address changed, recreate tunnel device")
+			c.close()
+		}
+		var err error
+		device, err = tun.CreateDevice(result.Address, result.Gateway)
+		if err != nil {
+			return err
+		}
+		c.lock.Lock()
+		c.device = device
+		c.dns = dns.New(device.Name)
+		c.push = nil
+		c.lock.Unlock()
+		go c.send(device)
+	}
+	// rules are installed again even if the device is kept, because the
+	// last installation may have failed
+	if c.killSwitch != nil {
+		if err := c.killSwitch.Enable(device.Name); err != nil {
+			return err
+		}
+	}
+	return c.configure(push)
+}
+
+// configure applies config to device. Routes are not touched if config is
+// not changed.
+func (c *client) configure(push *proto.PushConfig) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.device == nil {
+		return fmt.Errorf("device is closed")
+	}
+	if reflect.DeepEqual(c.push, push) {
+		return nil
+	}
+	if err := c.device.ClearRoutes(); err != nil {
+		return err
+	}
+	c.push = push
+	if err := apply(c.device, push); err != nil {
+		return err
+	}
+	if cfg.FullTunnel {
+		for _, r := range fullTunnelRoutes {
+			if err := c.device.AddRoute(r); err != nil {
+				return fmt.Errorf("can't add route %s: %s", r.String(), err)
+			}
+		}
+		log.Println("all traffic is sent through the tunnel")
+	}
+	// the tunnel still works without dns settings
+	if err := c.dns.Set(push.DNS, push.SearchDomains); err != nil {
+		log.Println("can't set dns", err)
+	} else if len(push.DNS) > 0 || len(push.SearchDomains) > 0 {
+		log.Println("dns servers", push.DNS, "search domains", push.SearchDomains)
+	}
+	return nil
+}
+
+// prepare adds the route to server and kill switch before connecting.
+// Changes are reverted if it failed, so nothing is left after exiting.
+func (c *client) prepare() error {
+	if !cfg.FullTunnel && !cfg.KillSwitch.Enabled {
+		return nil
+	}
+	if err := c.resolve(); err != nil {
+		return err
+	}
+	if cfg.FullTunnel {
+		if err := c.bypass(); err != nil {
+			return err
+		}
+	}
+	if cfg.KillSwitch.Enabled {
+		if err := c.block(); err != nil {
+			c.revert()
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve resolves server address only once, because routes and rules to
+// server are for a fixed ip.
+func (c *client) resolve() error {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Server)
+	if err != nil {
+		return err
+	}
+	c.server = addr.String()
+	c.endpoint = addr
+	return nil
+}
+
+// bypass adds a host route to server via the original gateway, so packets
+// to server don't go into the tunnel in full tunnel mode.
+func (c *client) bypass() error {
+	ip := c.endpoint.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("full tunnel requires an ipv4 server: %s", c.endpoint.IP)
+	}
+	gateway, err := tun.LookupGateway(ip)
+	if err != nil {
+		return err
+	}
+	if err := tun.AddHostRoute(ip, gateway); err != nil {
+		return fmt.Errorf("can't add route to server %s: %s", ip.String(), err)
+	}
+	log.Println("route to server", ip.String(), "via", gateway.String())
+	c.bypassed = ip
+	return nil
+}
+
+// block enables kill switch before connecting, so only traffic to server
+// is allowed until the tunnel device is created.
+func (c *client) block() error {
+	k := &firewall.KillSwitch{Server: c.endpoint}
+	for _, lan := range cfg.KillSwitch.LAN {
+		_, network, err := net.ParseCIDR(lan)
+		if err != nil {
+			return err
+		}
+		k.LAN = append(k.LAN, network)
+	}
+	if err := k.Enable(""); err != nil {
+		return err
+	}
+	log.Println("kill switch enabled")
+	c.killSwitch = k
+	return nil
+}
+
+// send sends packets from device to the current tunnel until the device is
+// closed. Packets are dropped if there is no tunnel.
+func (c *client) send(device *tun.Device) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := device.Read(buf)
+		if err != nil {
+			log.Println("sender", "read error", err)
+			return
+		}
+		c.lock.Lock()
+		tunnel := c.tunnel
+		c.lock.Unlock()
+		if tunnel == nil {
+			c.counter.drop()
+			continue
+		}
+		if _, err := tunnel.Write(buf[:n]); err != nil {
+			// the tunnel will be replaced by reconnecting
+			log.Println("sender", "write error", err)
+			c.counter.drop()
+			continue
+		}
+		c.counter.sent(n)
+	}
+}
+
+// receive writes packets from tunnel to device until the tunnel failed
+func (c *client) receive(tunnel *proto.Tunnel, device *tun.Device) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := tunnel.Read(buf)
+		if err != nil {
+			return err
+		}
+		c.counter.received(n)
+		wc, err := device.Write(buf[:n])
+		if err == nil && wc != n {
+			err = fmt.Errorf("read count: %d write count: %d", n, wc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// shutdown stops client and waits until shutdown timeout, then reverts dns
+// settings, routes and kill switch.
+func (c *client) shutdown(done <-chan struct{}) {
+	c.machine.trigger(eventStop, nil)
+	close(c.stop)
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout.Duration):
+		log.Println("shutdown timeout", cfg.ShutdownTimeout.Duration)
+	}
+	c.close()
+	c.revert()
+}
+
+// revert deletes the route to server and removes kill switch
+func (c *client) revert() {
+	if c.bypassed != nil {
+		if err := tun.DeleteHostRoute(c.bypassed); err != nil {
+			log.Println("can't delete route to server", err)
+		}
+	}
+	// kill switch is only removed when client exits normally
+	if c.killSwitch != nil {
+		if err := c.killSwitch.Disable(); err != nil {
+			log.Println(err)
+		} else {
+			log.Println("kill switch disabled")
+		}
+	}
+}
+
+// close reverts dns settings and closes the device. Routes are removed
+// when the device is closed.
+func (c *client) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.device == nil {
+		return
+	}
+	if err := c.dns.Revert(); err != nil {
+		log.Println("can't revert dns", err)
+	}
+	if err := c.device.Close(); err != nil {
+		log.Println("can't close device", err)
+	}
+	c.device = nil
+}
+
+// backoff returns the delay before a reconnection. It grows exponentially
+// from min to max with attempts, and jitter keeps clients from reconnecting
+// at the same time.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := max
+	// compare with max>>attempt, because min<<attempt may overflow
+	if attempt < 63 && min <= max>>uint(attempt) {
+		delay = min << uint(attempt)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// random delay in [delay/2, delay]
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	min, max := 5*time.Second, 5*time.Minute
+	for attempt := 0; attempt < 1000; attempt++ {
+		expected := max
+		if attempt < 6 {
+			expected = min << uint(attempt)
+		}
+		if delay := backoff(attempt, min, max); delay < expected/2 || delay > expected {
+			t.Fatalf("delay of attempt %d should be in [%s, %s], but got %s", attempt, expected/2, expected, delay)
+		}
+	}
+	if delay := backoff(100, time.Nanosecond, time.Nanosecond); delay < 0 || delay > time.Nanosecond {
+		t.Fatalf("delay should be at most 1ns, but got %s", delay)
+	}
+}
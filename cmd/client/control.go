@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// controlStatus describes client in control api
+type controlStatus struct {
+	State     string `json:"state"`
+	Server    string `json:"server"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway"`
+	RTT       string `json:"rtt"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	LastError string `json:"lastError"`
+}
+
+// control serves a local http api on a unix socket for controlling client:
+//     GET  /status      shows state, tunnel ips, rtt, traffic and the last error
+//     GET  /routes      lists routes of the tunnel device
+//     POST /reconnect   reconnects to server, or connects after disconnected
+//     POST /disconnect  disconnects from server until reconnect
+type control struct {
+	client *client
+}
+
+// serveControl starts control api on a unix socket which can only be
+// accessed by the current user. A stale socket left by a crashed client is
+// replaced.
+func serveControl(path string, c *client) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is used by another client", path)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket %s is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := listenControl(path)
+	if err != nil {
+		return nil, err
+	}
+	ctl := &control{c}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", ctl.status)
+	mux.HandleFunc("/routes", ctl.routes)
+	mux.HandleFunc("/reconnect", ctl.request("reconnect", c.reconnect))
+	mux.HandleFunc("/disconnect", ctl.request("disconnect", c.disconnect))
+	go func() {
+		log.Println("control api listening on", path)
+		log.Println("control api stopped", http.Serve(listener, mux))
+	}()
+	return listener, nil
+}
+
+// reply writes a json response
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// replyError writes an error response
+func replyError(w http.ResponseWriter, code int, err error) {
+	reply(w, code, map[string]string{"error": err.Error()})
+}
+
+// status shows the status of client
+func (ctl *control) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	c := ctl.client
+	result := controlStatus{
+		State:     string(c.machine.state()),
+		Server:    c.server,
+		RxPackets: atomic.LoadUint64(&c.counter.rxPackets),
+		RxBytes:   atomic.LoadUint64(&c.counter.rxBytes),
+		TxPackets: atomic.LoadUint64(&c.counter.txPackets),
+		TxBytes:   atomic.LoadUint64(&c.counter.txBytes),
+	}
+	c.lock.Lock()
+	if c.device != nil {
+		result.Address = c.device.SrcIP.String()
+		result.Gateway = c.device.DestIP.String()
+	}
+	if c.tunnel != nil {
+		result.RTT = c.tunnel.RTT().String()
+	}
+	if c.lastErr != nil {
+		result.LastError = c.lastErr.Error()
+	}
+	c.lock.Unlock()
+	reply(w, http.StatusOK, result)
+}
+
+// routes lists routes of the tunnel device
+func (ctl *control) routes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	c := ctl.client
+	result := make([]string, 0)
+	c.lock.Lock()
+	if c.device != nil {
+		for _, route := range c.device.Routes {
+			result = append(result, route.String())
+		}
+	}
+	c.lock.Unlock()
+	reply(w, http.StatusOK, result)
+}
+
+// request returns a handler which sends a request to client
+func (ctl *control) request(name string, send func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		if err := send(); err != nil {
+			replyError(w, http.StatusConflict, err)
+			return
+		}
+		log.Println(name, "is requested by control api")
+		reply(w, http.StatusOK, map[string]string{"requested": name})
+	}
+}
+
+// commands maps commands of cli to methods and paths of control api
+var commands = map[string][2]string{
+	"status":     {http.MethodGet, "/status"},
+	"routes":     {http.MethodGet, "/routes"},
+	"reconnect":  {http.MethodPost, "/reconnect"},
+	"disconnect": {http.MethodPost, "/disconnect"},
+}
+
+// commandNames returns sorted names of commands
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCommand sends a command to the control api of a running client and
+// prints the result
+func runCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("only one command is allowed: %s", strings.Join(commandNames(), ", "))
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %s, available commands: %s", args[0], strings.Join(commandNames(), ", "))
+	}
+	if cfg.Control == "" {
+		return fmt.Errorf("control socket is not set, use -control or the config file of client")
+	}
+	// the host is ignored when dialing the unix socket
+	req, err := http.NewRequest(command[0], "http://tinyvpn"+command[1], nil)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", cfg.Control)
+			},
+		},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't connect to client: %s", err)
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		result := map[string]string{}
+		if err := decoder.Decode(&result); err != nil {
+			return fmt.Errorf("%s: %s", resp.Status, err)
+		}
+		return fmt.Errorf("%s", result["error"])
+	}
+	switch args[0] {
+	case "status":
+		s := controlStatus{}
+		if err := decoder.Decode(&s); err != nil {
+			return err
+		}
+		for _, field := range [][2]string{
+			{"state", s.State},
+			{"server", s.Server},
+			{"address", s.Address},
+			{"gateway", s.Gateway},
+			{"rtt", s.RTT},
+			{"received", fmt.Sprintf("%d bytes, %d packets", s.RxBytes, s.RxPackets)},
+			{"sent", fmt.Sprintf("%d bytes, %d packets", s.TxBytes, s.TxPackets)},
+			{"last error", s.LastError},
+		} {
+			fmt.Printf("%-12s%s\n", field[0]+":", field[1])
+		}
+	case "routes":
+		routes := make([]string, 0)
+		if err := decoder.Decode(&routes); err != nil {
+			return err
+		}
+		for _, route := range routes {
+			fmt.Println(route)
+		}
+	default:
+		fmt.Println(args[0], "is requested")
+	}
+	return nil
+}
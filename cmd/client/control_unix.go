@@ -0,0 +1,16 @@
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenControl listens on a unix socket with mode 0600. The umask is set
+// while listening, so the socket is never accessible to other users.
+func listenControl(path string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
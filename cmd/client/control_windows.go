@@ -0,0 +1,11 @@
+// +build windows
+
+package main
+
+import "net"
+
+// listenControl listens on a unix socket. Its access is controlled by the
+// acl of its directory.
+func listenControl(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -1,74 +1,227 @@
 package main
 
 import (
+	"crypto/rand"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"flag"
 
+	"github.com/kdada/tinyvpn/pkg/config"
+	"github.com/kdada/tinyvpn/pkg/crypt"
+	"github.com/kdada/tinyvpn/pkg/metrics"
 	"github.com/kdada/tinyvpn/pkg/proto"
 	"github.com/kdada/tinyvpn/pkg/tun"
-	"github.com/xtaci/kcp-go"
 )
 
-var server string
-var local string
-var remote string
-var route string
+// authTimeout is the max duration for waiting authentication result
+const authTimeout = 10 * time.Second
+
+// cfg is the config of client. It's loaded from config file if -c is set,
+// otherwise it's made up of flags.
+var cfg = config.DefaultClient()
+
+var configFile string
+var checkConfig bool
+var lan string
 
 func init() {
-	flag.StringVar(&server, "s", "", "host:port e.g. 22.22.22.22:9989")
-	flag.StringVar(&local, "l", "", "local ip e.g. 10.0.0.2")
-	flag.StringVar(&remote, "r", "", "remote ip e.g. 10.0.0.1")
-	flag.StringVar(&route, "d", "", "default route e.g. 10.0.0.0/24")
+	flag.StringVar(&configFile, "c", "", "config file e.g. /etc/tinyvpn/client.json, other flags can't be used with it")
+	flag.BoolVar(&checkConfig, "check-config", false, "check config and exit")
+	flag.StringVar(&cfg.Server, "s", "", "host:port e.g. 22.22.22.22:9989")
+	flag.StringVar(&cfg.Transport.Key, "key", "", "pre-shared key of tunnel, must be same as the server")
+	flag.StringVar(&cfg.Auth.Account, "account", "", "account of client")
+	flag.StringVar(&cfg.Auth.Secret, "secret", "", "secret key of account")
+	flag.DurationVar(&cfg.Tunnel.Keepalive.Duration, "keepalive", cfg.Tunnel.Keepalive.Duration, "interval of keepalives, 0 means no keepalive")
+	flag.DurationVar(&cfg.Tunnel.Timeout.Duration, "timeout", cfg.Tunnel.Timeout.Duration, "peer is considered dead if nothing received in the duration, 0 means no timeout")
+	flag.DurationVar(&cfg.Tunnel.IdleTimeout.Duration, "idle", 0, "disconnect if no ip packet in the duration, it requires keepalive, 0 means no idle timeout")
+	flag.BoolVar(&cfg.FullTunnel, "full", false, "send all ipv4 traffic through the tunnel")
+	flag.BoolVar(&cfg.KillSwitch.Enabled, "kill-switch", false, "block traffic out of the tunnel via nftables, linux only")
+	flag.StringVar(&lan, "lan", "", "local networks which can be accessed with kill switch e.g. 192.168.1.0/24")
+	flag.DurationVar(&cfg.Reconnect.MinDelay.Duration, "reconnect-min", cfg.Reconnect.MinDelay.Duration, "delay before the first reconnection")
+	flag.DurationVar(&cfg.Reconnect.MaxDelay.Duration, "reconnect-max", cfg.Reconnect.MaxDelay.Duration, "max delay between reconnections")
+	flag.DurationVar(&cfg.ShutdownTimeout.Duration, "shutdown-timeout", cfg.ShutdownTimeout.Duration, "max duration for stopping the tunnel when exiting")
+	flag.StringVar(&cfg.Control, "control", "", "unix socket of control api used by commands e.g. /var/run/tinyvpn.sock, empty means disabled")
+	flag.StringVar(&cfg.Metrics, "metrics", "", "address of prometheus metrics e.g. 127.0.0.1:9991, empty means disabled")
+	flag.StringVar(&cfg.Log.File, "log", "", "log file, empty means stderr")
+	flag.StringVar(&cfg.Transport.Crypt, "crypt", cfg.Transport.Crypt, "crypt method of tunnel: "+strings.Join(crypt.Methods(), ", "))
+}
+
+// loadConfig loads config from config file or flags
+func loadConfig() error {
+	if configFile == "" {
+		cfg.KillSwitch.LAN = splitList(lan)
+		return cfg.Validate()
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "c" && f.Name != "check-config" {
+			err = fmt.Errorf("flag -%s can't be used with config file", f.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c, err := config.LoadClient(configFile)
+	if err != nil {
+		return err
+	}
+	cfg = c
+	return nil
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands are sent to a running client via control api: %s\n", strings.Join(commandNames(), ", "))
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	log.SetFlags(log.Lshortfile | log.Ldate)
+	if flag.NArg() > 0 {
+		if configFile != "" {
+			c, err := config.LoadClient(configFile)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			cfg = c
+		}
+		if err := runCommand(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatalln(err)
+	}
+	if checkConfig {
+		log.Println("config is valid")
+		return
+	}
+	if err := cfg.Log.Setup(); err != nil {
+		log.Fatalln(err)
+	}
 	log.Println("tinyvpn client started")
-	device, err := tun.CreateDevice(net.ParseIP(local), net.ParseIP(remote))
-	if err != nil {
+	c := newClient()
+	if cfg.Metrics != "" {
+		if err := metrics.Serve(cfg.Metrics, c.counter.collect); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := c.prepare(); err != nil {
 		log.Fatalln(err)
 	}
-	defer device.Close()
+	// system settings have been changed, so revert them before exiting
+	if cfg.Control != "" {
+		listener, err := serveControl(cfg.Control, c)
+		if err != nil {
+			c.revert()
+			log.Fatalln(err)
+		}
+		// the socket file is removed when closing
+		defer listener.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		c.run()
+		close(done)
+	}()
 
-	// add route
-	_, r, err := net.ParseCIDR(route)
-	if err != nil {
-		log.Fatalln(err)
+	sig := make(chan os.Signal, 1)
+	// system settings are reverted by shutdown, so catch signals which
+	// terminate the client by default
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	log.Println("exit because of", <-sig)
+	c.shutdown(done)
+	log.Println("tinyvpn client stoped")
+}
+
+// splitList splits a comma separated list
+func splitList(list string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
 	}
-	device.AddRoute(r)
+	return result
+}
 
-	// connect
-	conn, err := kcp.DialWithOptions(server, nil, 10, 3)
-	conn.SetNoDelay(1, 30, 2, 1)
-	conn.SetReadBuffer(4096 * 1024)
-	conn.SetWriteBuffer(4096 * 1024)
-	conn.SetWindowSize(1024, 1024)
-	conn.SetACKNoDelay(true)
+// authenticate sends authentication with the preferred tunnel ip to server
+// and waits for the result, then returns a secure conn with traffic keys
+// derived from ephemeral keys and the result which contains assigned tunnel ip.
+func authenticate(conn net.Conn, preferred net.IP) (net.Conn, *proto.AuthResult, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	private, err := proto.GenerateKey()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	log.Println("tunnel connected")
-
-	running := true
-
-	sender := proto.Pipe("sender", &running, device, conn)
-	receiver := proto.Pipe("receiver", &running, conn, device)
+	secretKey := crypt.DeriveKey(cfg.Auth.Secret)
+	auth := &proto.Authentication{
+		Account:   cfg.Auth.Account,
+		Timestamp: uint32(time.Now().Unix()),
+		Key:       key,
+		PublicKey: private.PublicKey().Bytes(),
+		Address:   preferred,
+		SecretKey: secretKey,
+	}
+	if err = proto.WriteMessage(conn, proto.TypeAuthentication, auth); err != nil {
+		return nil, nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	result := &proto.AuthResult{Key: key, SecretKey: secretKey}
+	if err = proto.ReadMessage(conn, proto.TypeAuthResult, result); err != nil {
+		return nil, nil, fmt.Errorf("authentication failed: %s", err)
+	}
+	if !result.Accepted {
+		return nil, nil, fmt.Errorf("authentication rejected: %s", result.Reason)
+	}
+	clientKey, serverKey, err := proto.SessionKeys(private, result.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	secureConn, err := proto.NewSecureConn(conn, clientKey, serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secureConn, result, nil
+}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+// receiveConfig receives the config pushed by server
+func receiveConfig(conn net.Conn) (*proto.PushConfig, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	push := &proto.PushConfig{}
+	if err := proto.ReadMessage(conn, proto.TypeConfig, push); err != nil {
+		return nil, fmt.Errorf("can't receive config: %s", err)
+	}
+	return push, nil
+}
 
-	select {
-	case <-sender:
-		log.Println("exit because of sender failed")
-	case <-receiver:
-		log.Println("exit because of receiver failed")
-	case <-sig:
-		log.Println("exit because of user")
+// apply applies mtu and routes of config to device
+func apply(device *tun.Device, push *proto.PushConfig) error {
+	if push.MTU > 0 {
+		if err := device.SetMTU(int(push.MTU)); err != nil {
+			return fmt.Errorf("can't set mtu %d: %s", push.MTU, err)
+		}
 	}
-	log.Println("tinyvpn client stoped")
+	for _, r := range push.Routes {
+		if err := device.AddRoute(r); err != nil {
+			return fmt.Errorf("can't add route %s: %s", r.String(), err)
+		}
+		log.Println("add route", r.String())
+	}
+	return nil
 }
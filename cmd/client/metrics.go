@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/kdada/tinyvpn/pkg/metrics"
+	"github.com/xtaci/kcp-go"
+)
+
+// counter counts ip packets passing through tunnels
+type counter struct {
+	rxPackets uint64
+	rxBytes   uint64
+	txPackets uint64
+	txBytes   uint64
+	dropped   uint64
+}
+
+// received records a packet received from server
+func (c *counter) received(n int) {
+	atomic.AddUint64(&c.rxPackets, 1)
+	atomic.AddUint64(&c.rxBytes, uint64(n))
+}
+
+// sent records a packet sent to server
+func (c *counter) sent(n int) {
+	atomic.AddUint64(&c.txPackets, 1)
+	atomic.AddUint64(&c.txBytes, uint64(n))
+}
+
+// drop records a packet dropped by client
+func (c *counter) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+}
+
+// collect writes kcp counters and counters of tunnel
+func (c *counter) collect(w *metrics.Writer) {
+	metrics.WriteSnmp(w, kcp.DefaultSnmp)
+	for _, m := range []struct {
+		name  string
+		help  string
+		value *uint64
+	}{
+		{"tinyvpn_tunnel_rx_packets_total", "Packets received from server.", &c.rxPackets},
+		{"tinyvpn_tunnel_rx_bytes_total", "Bytes received from server.", &c.rxBytes},
+		{"tinyvpn_tunnel_tx_packets_total", "Packets sent to server.", &c.txPackets},
+		{"tinyvpn_tunnel_tx_bytes_total", "Bytes sent to server.", &c.txBytes},
+		{"tinyvpn_tunnel_dropped_total", "Packets dropped by client because the tunnel is down.", &c.dropped},
+	} {
+		w.Describe(m.name, metrics.Counter, m.help)
+		w.Sample(m.name, atomic.LoadUint64(m.value))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/session"
+)
+
+// sessionInfo describes a session in admin api
+type sessionInfo struct {
+	Account    string        `json:"account"`
+	Address    string        `json:"address"`
+	RemoteAddr string        `json:"remoteAddr"`
+	StartTime  time.Time     `json:"startTime"`
+	Uptime     string        `json:"uptime"`
+	RTT        string        `json:"rtt"`
+	Stats      session.Stats `json:"stats"`
+}
+
+// admin serves a local http api for managing sessions and accounts. Requests
+// from browsers are rejected:
+//     GET  /sessions                      lists sessions
+//     POST /sessions/disconnect?address=  disconnects the session of a tunnel ip
+//     POST /accounts/disable?name=        disables an account and disconnects its sessions
+//     POST /accounts/enable?name=         enables an account
+//     POST /reload                        reloads config and accounts
+type admin struct {
+	accounts *account.Store
+	sessions *session.Manager
+	reload   func() error
+}
+
+// serveAdmin starts admin api on a loopback address
+func serveAdmin(addr string, accounts *account.Store, sessions *session.Manager, reload func() error) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin address must be a loopback address: %s", addr)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	a := &admin{accounts, sessions, reload}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", a.listSessions)
+	mux.HandleFunc("/sessions/disconnect", a.disconnect)
+	mux.HandleFunc("/accounts/disable", a.setEnabled(false))
+	mux.HandleFunc("/accounts/enable", a.setEnabled(true))
+	mux.HandleFunc("/reload", a.reloadConfig)
+	go func() {
+		log.Println("admin api listening on", addr)
+		log.Println("admin api stopped", http.Serve(listener, local(mux)))
+	}()
+	return nil
+}
+
+// local rejects requests which may come from web pages. Browsers send
+// Origin with cross-site POST requests, and requests of dns rebinding
+// carry a non-loopback Host.
+func local(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			replyError(w, http.StatusForbidden, fmt.Errorf("requests from browsers are not allowed"))
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			replyError(w, http.StatusForbidden, fmt.Errorf("host %s is not allowed", r.Host))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// reply writes a json response
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// replyError writes an error response
+func replyError(w http.ResponseWriter, code int, err error) {
+	reply(w, code, map[string]string{"error": err.Error()})
+}
+
+// listSessions lists all sessions
+func (a *admin) listSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	result := make([]sessionInfo, 0)
+	for _, s := range a.sessions.List() {
+		result = append(result, sessionInfo{
+			Account:    s.Account().Name,
+			Address:    s.Address.String(),
+			RemoteAddr: s.RemoteAddr.String(),
+			StartTime:  s.StartTime,
+			Uptime:     time.Since(s.StartTime).String(),
+			RTT:        s.Tunnel.RTT().String(),
+			Stats:      s.Stats(),
+		})
+	}
+	reply(w, http.StatusOK, result)
+}
+
+// disconnect disconnects a session
+func (a *admin) disconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	address := r.URL.Query().Get("address")
+	s, ok := a.sessions.Get(net.ParseIP(address))
+	if !ok {
+		replyError(w, http.StatusNotFound, fmt.Errorf("no session with address %s", address))
+		return
+	}
+	log.Println(s.Name(), "disconnected by administrator")
+	s.Close("disconnected by administrator")
+	reply(w, http.StatusOK, map[string]string{"disconnected": s.Name()})
+}
+
+// setEnabled returns a handler to enable or disable an account
+func (a *admin) setEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if err := a.accounts.SetEnabled(name, enabled); err != nil {
+			replyError(w, http.StatusNotFound, err)
+			return
+		}
+		disconnected := make([]string, 0)
+		if !enabled {
+			for _, s := range a.sessions.List() {
+				if s.Account().Name == name {
+					log.Println(s.Name(), "disconnected because account is disabled")
+					s.Close("account is disabled")
+					disconnected = append(disconnected, s.Name())
+				}
+			}
+		}
+		reply(w, http.StatusOK, map[string]interface{}{"account": name, "enabled": enabled, "disconnected": disconnected})
+	}
+}
+
+// reloadConfig reloads config and accounts
+func (a *admin) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	if err := a.reload(); err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/crypt"
+	"github.com/kdada/tinyvpn/pkg/ipam"
+	"github.com/kdada/tinyvpn/pkg/proto"
+	"github.com/kdada/tinyvpn/pkg/replay"
+	"github.com/kdada/tinyvpn/pkg/session"
+)
+
+// authTimeout is the max duration for waiting authentication
+const authTimeout = 10 * time.Second
+
+// authenticator verifies clients and assigns tunnel ips to them
+type authenticator struct {
+	// accounts is the account store
+	accounts *account.Store
+	// replays records seen authentications
+	replays *replay.Cache
+	// pool assigns tunnel ips of clients
+	pool *ipam.IPAM
+	// sessions is used to replace sessions of reconnecting clients
+	sessions *session.Manager
+	// gateway is the tunnel ip of server
+	gateway net.IP
+	// lock protects config
+	lock sync.RWMutex
+	// config is pushed to clients after authentication
+	config *proto.PushConfig
+}
+
+// authenticate reads the first frame of conn and verifies it, then exchanges
+// ephemeral keys with client and returns a secure conn with fresh traffic keys
+// and an assigned tunnel ip. Conn is closed with a reason if authentication failed.
+func (a *authenticator) authenticate(conn net.Conn) (*proto.SecureConn, *account.Account, net.IP, error) {
+	auth, acc, err := a.readAuthentication(conn)
+	result := &proto.AuthResult{Accepted: err == nil}
+	var secureConn *proto.SecureConn
+	var ip net.IP
+	if err != nil {
+		// the detailed reason is only logged, so unauthenticated peers
+		// can't probe which accounts exist
+		result.Reason = "authentication failed"
+	} else {
+		ip, err = a.assign(acc, auth.Address)
+		if err == nil {
+			result.Address = ip
+			result.Gateway = a.gateway
+			secureConn, err = exchangeKeys(conn, auth, result)
+		}
+		result.Accepted = err == nil
+		if err != nil {
+			result.Reason = err.Error()
+		}
+	}
+	if werr := proto.WriteMessage(conn, proto.TypeAuthResult, result); err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = a.push(secureConn, acc)
+	}
+	if err != nil {
+		if ip != nil {
+			a.pool.Retire(ip)
+		}
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return secureConn, acc, ip, nil
+}
+
+// push sends config to client
+func (a *authenticator) push(conn net.Conn, acc *account.Account) error {
+	return proto.WriteMessage(conn, proto.TypeConfig, a.configOf(acc))
+}
+
+// configOf returns the config of an account. Subnets behind other clients
+// are added to routes.
+func (a *authenticator) configOf(acc *account.Account) *proto.PushConfig {
+	a.lock.RLock()
+	config := *a.config
+	a.lock.RUnlock()
+	config.Routes = append([]*net.IPNet(nil), config.Routes...)
+	for _, other := range a.accounts.List() {
+		if other.Name != acc.Name {
+			config.Routes = append(config.Routes, other.Networks()...)
+		}
+	}
+	return &config
+}
+
+// setConfig replaces the config pushed to clients
+func (a *authenticator) setConfig(config *proto.PushConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.config = config
+}
+
+// reserve reserves specified addresses of all accounts, so they are not
+// assigned to accounts without specified addresses
+func (a *authenticator) reserve() {
+	ips := make([]net.IP, 0)
+	for _, acc := range a.accounts.List() {
+		for _, addr := range acc.Addresses {
+			ips = append(ips, net.ParseIP(addr))
+		}
+	}
+	a.pool.Reserve(ips)
+}
+
+// assign assigns a tunnel ip to account. The preferred address is used if
+// it's available, and a session of the same account using it is replaced
+// because its client is reconnecting. Otherwise if the account has specified
+// addresses, it uses the first unused one. Accounts without specified
+// addresses never get addresses specified by other accounts.
+func (a *authenticator) assign(acc *account.Account, preferred net.IP) (net.IP, error) {
+	if preferred != nil && acc.AllowAddress(preferred) && (len(acc.Addresses) > 0 || !a.pool.IsReserved(preferred)) {
+		if old, ok := a.sessions.Get(preferred); ok && old.Account().Name == acc.Name {
+			log.Println(old.Name(), "replaced by new connection")
+			old.Close("replaced by new connection")
+		}
+		if a.pool.Acquire(preferred) == nil {
+			return preferred.To4(), nil
+		}
+	}
+	if len(acc.Addresses) == 0 {
+		return a.pool.Assign()
+	}
+	for _, addr := range acc.Addresses {
+		ip := net.ParseIP(addr).To4()
+		if a.pool.Acquire(ip) == nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no available address for account %s", acc.Name)
+}
+
+// exchangeKeys generates an ephemeral key for result and derives traffic keys
+func exchangeKeys(conn net.Conn, auth *proto.Authentication, result *proto.AuthResult) (*proto.SecureConn, error) {
+	private, err := proto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	clientKey, serverKey, err := proto.SessionKeys(private, auth.PublicKey, auth.Key)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %s", err)
+	}
+	result.PublicKey = private.PublicKey().Bytes()
+	result.Key = auth.Key
+	result.SecretKey = auth.SecretKey
+	return proto.NewSecureConn(conn, serverKey, clientKey)
+}
+
+// readAuthentication reads an authentication and verifies account, secret key and timestamp
+func (a *authenticator) readAuthentication(conn net.Conn) (*proto.Authentication, *account.Account, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	p, err := proto.ReadFrame(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Type != proto.TypeAuthentication {
+		return nil, nil, fmt.Errorf("unexpected protocal type: %d", p.Type)
+	}
+	auth := &proto.Authentication{}
+	if err := auth.Unmarshal(p.Data); err != nil {
+		return nil, nil, err
+	}
+	acc, ok := a.accounts.Get(auth.Account)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown account: %s", auth.Account)
+	}
+	if !acc.Enabled {
+		return nil, nil, fmt.Errorf("account %s is disabled", auth.Account)
+	}
+	auth.SecretKey = crypt.DeriveKey(acc.SecretKey)
+	if err := auth.Unmarshal(p.Data); err != nil {
+		return nil, nil, fmt.Errorf("invalid secret key of account %s", auth.Account)
+	}
+	if !a.replays.InWindow(auth.Timestamp) {
+		return nil, nil, fmt.Errorf("timestamp of account %s is out of range: %s", auth.Account,
+			time.Since(time.Unix(int64(auth.Timestamp), 0)))
+	}
+	if !a.replays.Check(auth.Account, auth.Timestamp, auth.Key) {
+		return nil, nil, fmt.Errorf("replayed authentication of account %s", auth.Account)
+	}
+	return auth, acc, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/ipam"
+	"github.com/kdada/tinyvpn/pkg/proto"
+	"github.com/kdada/tinyvpn/pkg/session"
+)
+
+// newTestAuthenticator creates an authenticator of 10.0.0.0/24. Alice owns
+// 10.0.0.10 and 10.0.0.11, bob and carol have no specified addresses.
+func newTestAuthenticator(t *testing.T, dir string) *authenticator {
+	path := filepath.Join(dir, "accounts.json")
+	data := `{"accounts": [
+		{"name": "alice", "secretKey": "a", "enabled": true, "addresses": ["10.0.0.10", "10.0.0.11"]},
+		{"name": "bob", "secretKey": "b", "enabled": true},
+		{"name": "carol", "secretKey": "c", "enabled": true}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := account.NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, _ := net.ParseCIDR("10.0.0.0/24")
+	pool, err := ipam.NewIPAM(*r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{accounts: accounts, pool: pool, sessions: session.NewManager()}
+	a.reserve()
+	return a
+}
+
+// connect adds a session of account with address
+func connect(t *testing.T, a *authenticator, name string, address string) *session.Session {
+	acc, _ := a.accounts.Get(name)
+	ip := net.ParseIP(address).To4()
+	if err := a.pool.Acquire(ip); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go io.Copy(ioutil.Discard, c2)
+	s := session.NewSession(acc, ip, c1.RemoteAddr(), proto.NewTunnel(name, c1))
+	s.Release = func() {
+		a.pool.Retire(ip)
+		c2.Close()
+	}
+	if err := a.sessions.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAssign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, c := range []struct {
+		name      string
+		sessions  map[string]string
+		account   string
+		preferred string
+		expected  string
+		replaced  bool
+	}{
+		{"unused preferred address", nil, "bob", "10.0.0.5", "10.0.0.5", false},
+		{"preferred address used by another account", map[string]string{"10.0.0.5": "carol"}, "bob", "10.0.0.5", "10.0.0.1", false},
+		{"preferred address reserved for another account", nil, "bob", "10.0.0.10", "10.0.0.1", false},
+		{"session of the same account is replaced", map[string]string{"10.0.0.5": "bob"}, "bob", "10.0.0.5", "10.0.0.5", true},
+		{"preferred address not specified by account", nil, "alice", "10.0.0.5", "10.0.0.10", false},
+		{"next specified address", map[string]string{"10.0.0.10": "bob"}, "alice", "", "10.0.0.11", false},
+		{"specified addresses are exhausted", map[string]string{"10.0.0.10": "bob", "10.0.0.11": "carol"}, "alice", "10.0.0.10", "", false},
+	} {
+		a := newTestAuthenticator(t, dir)
+		sessions := make([]*session.Session, 0)
+		for address, name := range c.sessions {
+			sessions = append(sessions, connect(t, a, name, address))
+		}
+		acc, _ := a.accounts.Get(c.account)
+		ip, err := a.assign(acc, net.ParseIP(c.preferred))
+		if c.expected == "" {
+			if err == nil {
+				t.Fatalf("%s: no address should be assigned, but got %s", c.name, ip)
+			}
+		} else if err != nil || !ip.Equal(net.ParseIP(c.expected)) {
+			t.Fatalf("%s: %s should be assigned, but got %s, %v", c.name, c.expected, ip, err)
+		}
+		for _, s := range sessions {
+			select {
+			case <-s.Closed():
+				if !c.replaced {
+					t.Fatalf("%s: session %s should not be replaced", c.name, s.Address)
+				}
+			default:
+				if c.replaced {
+					t.Fatalf("%s: session %s should be replaced", c.name, s.Address)
+				}
+				s.Close("")
+			}
+		}
+	}
+}
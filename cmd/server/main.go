@@ -1,60 +1,280 @@
 package main
 
 import (
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/config"
+	"github.com/kdada/tinyvpn/pkg/crypt"
+	"github.com/kdada/tinyvpn/pkg/ipam"
+	"github.com/kdada/tinyvpn/pkg/metrics"
+	"github.com/kdada/tinyvpn/pkg/proto"
+	"github.com/kdada/tinyvpn/pkg/replay"
+	"github.com/kdada/tinyvpn/pkg/session"
 	"github.com/kdada/tinyvpn/pkg/tun"
 	"github.com/xtaci/kcp-go"
 )
 
+// cfg is the config of server. It's loaded from config file if -c is set,
+// otherwise it's made up of flags.
+var cfg = config.DefaultServer()
+
+// isolate is 1 if traffic between clients is dropped. It can be changed by
+// reloading.
+var isolate int32
+
+var configFile string
+var checkConfig bool
 var server string
-var local string
-var remote string
-var route string
+var pushRoutes string
+var dnsServers string
+var searchDomains string
 
 func init() {
-	flag.StringVar(&server, "s", "", "host:port e.g. 22.22.22.22:9989")
-	flag.StringVar(&local, "l", "", "local ip e.g. 10.0.0.1")
-	flag.StringVar(&remote, "r", "", "remote ip e.g. 10.0.0.2")
-	flag.StringVar(&route, "d", "", "default route e.g. 10.0.0.0/24")
+	flag.StringVar(&configFile, "c", "", "config file e.g. /etc/tinyvpn/server.json, other flags can't be used with it")
+	flag.BoolVar(&checkConfig, "check-config", false, "check config and exit")
+	flag.StringVar(&server, "s", "", "comma separated listen addresses e.g. 22.22.22.22:9989,[::]:9989,:443, an address without host listens on ipv4 and ipv6")
+	flag.StringVar(&cfg.Tunnel.Local, "l", "", "local ip e.g. 10.0.0.1")
+	flag.StringVar(&cfg.Tunnel.Remote, "r", "", "remote ip e.g. 10.0.0.2")
+	flag.StringVar(&cfg.Tunnel.Network, "d", "", "default route and address pool of clients e.g. 10.0.0.0/24")
+	flag.StringVar(&cfg.Transport.Key, "key", "", "pre-shared key of tunnel, must be same as the clients")
+	flag.StringVar(&cfg.Auth.Accounts, "accounts", "", "account file e.g. /etc/tinyvpn/accounts.json")
+	flag.DurationVar(&cfg.Auth.ClockSkew.Duration, "skew", cfg.Auth.ClockSkew.Duration, "max clock skew between clients and server")
+	flag.IntVar(&cfg.Auth.ReplayCache, "replay-cache", cfg.Auth.ReplayCache, "max count of authentications remembered for replay detection")
+	flag.StringVar(&pushRoutes, "routes", "", "extra routes pushed to clients e.g. 192.168.1.0/24,192.168.2.0/24")
+	flag.StringVar(&dnsServers, "dns", "", "dns servers pushed to clients e.g. 10.0.0.1,8.8.8.8")
+	flag.StringVar(&searchDomains, "search", "", "dns search domains pushed to clients e.g. corp.example.com")
+	flag.IntVar(&cfg.Tunnel.MTU, "mtu", 0, "mtu of tunnel devices, at most 4000, 0 means system default")
+	flag.BoolVar(&cfg.Tunnel.Isolate, "isolate", false, "drop traffic between clients")
+	flag.StringVar(&cfg.Admin, "admin", "", "loopback address of admin api e.g. 127.0.0.1:9990, empty means disabled")
+	flag.StringVar(&cfg.Metrics, "metrics", "", "address of prometheus metrics e.g. 127.0.0.1:9991, it exposes account names and client addresses, empty means disabled")
+	flag.StringVar(&cfg.Log.File, "log", "", "log file, empty means stderr")
+	flag.DurationVar(&cfg.ShutdownTimeout.Duration, "shutdown-timeout", cfg.ShutdownTimeout.Duration, "max duration for disconnecting clients when exiting")
+	flag.DurationVar(&cfg.Tunnel.Keepalive.Duration, "keepalive", cfg.Tunnel.Keepalive.Duration, "interval of keepalives, 0 means no keepalive")
+	flag.DurationVar(&cfg.Tunnel.Timeout.Duration, "timeout", cfg.Tunnel.Timeout.Duration, "peer is considered dead if nothing received in the duration, 0 means no timeout")
+	flag.DurationVar(&cfg.Tunnel.IdleTimeout.Duration, "idle", 0, "disconnect if no ip packet in the duration, it requires keepalive, 0 means no idle timeout")
+	flag.StringVar(&cfg.Transport.Crypt, "crypt", cfg.Transport.Crypt, "crypt method of tunnel: "+strings.Join(crypt.Methods(), ", "))
+}
+
+// loadConfig loads config from config file or flags
+func loadConfig() error {
+	if configFile == "" {
+		cfg.Listen = splitList(server)
+		cfg.Push.Routes = splitList(pushRoutes)
+		cfg.Push.DNS = splitList(dnsServers)
+		cfg.Push.SearchDomains = splitList(searchDomains)
+		return cfg.Validate()
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "c" && f.Name != "check-config" {
+			err = fmt.Errorf("flag -%s can't be used with config file", f.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c, err := config.LoadServer(configFile)
+	if err != nil {
+		return err
+	}
+	cfg = c
+	return nil
 }
 
 func main() {
 	flag.Parse()
 	log.SetFlags(log.Lshortfile | log.Ldate)
+	if err := loadConfig(); err != nil {
+		log.Fatalln(err)
+	}
+	if checkConfig {
+		// accounts are a part of config
+		if _, err := account.NewStore(cfg.Auth.Accounts); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("config is valid")
+		return
+	}
+	if err := cfg.Log.Setup(); err != nil {
+		log.Fatalln(err)
+	}
 	log.Println("tinyvpn server started")
-	log.Println(local, remote)
-	device, err := tun.CreateDevice(net.ParseIP(local), net.ParseIP(remote))
+	log.Println(cfg.Tunnel.Local, cfg.Tunnel.Remote)
+	accounts, err := account.NewStore(cfg.Auth.Accounts)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer device.Close()
-
-	// add route
-	_, r, err := net.ParseCIDR(route)
+	_, r, err := net.ParseCIDR(cfg.Tunnel.Network)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pool, err := ipam.NewIPAM(*r)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// server ips can't be assigned to clients
+	for _, ip := range []string{cfg.Tunnel.Local, cfg.Tunnel.Remote} {
+		if r.Contains(net.ParseIP(ip)) {
+			if err := pool.Acquire(net.ParseIP(ip)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	push, err := pushConfig(r, cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	device, err := tun.CreateDevice(net.ParseIP(cfg.Tunnel.Local), net.ParseIP(cfg.Tunnel.Remote))
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer device.Close()
+	if cfg.Tunnel.MTU > 0 {
+		if err := device.SetMTU(cfg.Tunnel.MTU); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// add route
 	device.AddRoute(r)
+	// add routes of subnets behind clients
+	for _, acc := range accounts.List() {
+		for _, subnet := range acc.Networks() {
+			if err := device.AddRoute(subnet); err != nil {
+				log.Fatalln("can't add subnet", subnet.String(), "of account", acc.Name, err)
+			}
+		}
+	}
 
-	handle(device)
-	listen(device)
+	if cfg.Tunnel.Isolate {
+		isolate = 1
+	}
+	sessions := session.NewManager()
+	auth := &authenticator{
+		accounts: accounts,
+		replays:  replay.NewCache(cfg.Auth.ClockSkew.Duration, cfg.Auth.ReplayCache),
+		pool:     pool,
+		sessions: sessions,
+		gateway:  net.ParseIP(cfg.Tunnel.Local),
+		config:   push,
+	}
+	auth.reserve()
+	reloader := &reloader{
+		network:  r,
+		device:   device,
+		sessions: sessions,
+		auth:     auth,
+	}
+	if cfg.Admin != "" {
+		if err := serveAdmin(cfg.Admin, accounts, sessions, reloader.reload); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if cfg.Metrics != "" {
+		if err := metrics.Serve(cfg.Metrics, collect(sessions)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	handle(device, sessions)
+	// all listeners share sessions and device
+	listeners := make([]*kcp.Listener, 0, len(cfg.Listen))
+	for _, addr := range cfg.Listen {
+		listeners = append(listeners, listen(addr, device, sessions, auth))
+	}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			log.Println("shutting down because of", s)
+			break
+		}
+		if err := reloader.reload(); err != nil {
+			log.Println("reload failed", err)
+		}
+	}
+	shutdown(listeners, sessions)
 	log.Println("tinyvpn server stoped")
 }
 
-var conns = make(map[uint32]net.Conn)
+// shutdown disconnects all sessions and closes listeners. It stops waiting
+// for sessions after shutdown timeout.
+func shutdown(listeners []*kcp.Listener, sessions *session.Manager) {
+	done := make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		for _, s := range sessions.List() {
+			wg.Add(1)
+			go func(s *session.Session) {
+				defer wg.Done()
+				s.Close("server is shutting down")
+			}(s)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout.Duration):
+		log.Println("shutdown timeout", cfg.ShutdownTimeout.Duration)
+	}
+	// sessions share sockets of listeners, so close them at last
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
 
-func handle(device *tun.Device) {
+// pushConfig creates the config pushed to clients. It contains the route of
+// tunnel and extra routes of c.
+func pushConfig(r *net.IPNet, c *config.Server) (*proto.PushConfig, error) {
+	push := &proto.PushConfig{
+		MTU:           uint16(c.Tunnel.MTU),
+		Routes:        []*net.IPNet{r},
+		DNS:           make([]net.IP, 0),
+		SearchDomains: make([]string, 0),
+	}
+	for _, route := range c.Push.Routes {
+		_, r, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, err
+		}
+		push.Routes = append(push.Routes, r)
+	}
+	for _, dns := range c.Push.DNS {
+		ip := net.ParseIP(dns).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns server: %s", dns)
+		}
+		push.DNS = append(push.DNS, ip)
+	}
+	push.SearchDomains = append(push.SearchDomains, c.Push.SearchDomains...)
+	return push, nil
+}
+
+// splitList splits a comma separated list
+func splitList(list string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func handle(device *tun.Device, sessions *session.Manager) {
 	go func() {
 		buf := make([]byte, 4096)
 		for true {
@@ -64,90 +284,135 @@ func handle(device *tun.Device) {
 				break
 			}
 			ipp := tun.IPPacket(buf[:rc])
-			ip := convertIP(ipp.DestIP())
-			conn, ok := conns[ip]
-			if ok {
-				wc, err := conn.Write(buf[:rc])
-				if err == nil && wc != rc {
-					err = fmt.Errorf("read count: %d write count: %d", rc, wc)
-				}
-				if err != nil {
-					log.Println(conn.RemoteAddr(), "closed connection", err)
-					conn.Close()
-					delete(conns, ip)
-				}
+			if ipp.Validate() != nil {
+				continue
+			}
+			if s, ok := sessions.Lookup(ipp.DestIP()); ok {
+				// buf is reused, so queue a copy
+				s.Enqueue(append([]byte(nil), buf[:rc]...))
 			}
 		}
 	}()
 }
 
-func listen(device *tun.Device) {
-	listener, err := kcp.ListenWithOptions(server, nil, 10, 3)
+// listen accepts clients on addr
+func listen(addr string, device *tun.Device, sessions *session.Manager, auth *authenticator) *kcp.Listener {
+	block, err := crypt.NewBlockCrypt(cfg.Transport.Crypt, cfg.Transport.Key)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	conn, err := listenUDP(addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	listener.SetReadBuffer(4096 * 1024)
-	listener.SetWriteBuffer(4096 * 1024)
+	listener, err := kcp.ServeConn(block, cfg.Transport.KCP.DataShards, cfg.Transport.KCP.ParityShards, conn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("listening on", listener.Addr())
+	listener.SetReadBuffer(cfg.Transport.KCP.ReadBuffer)
+	listener.SetWriteBuffer(cfg.Transport.KCP.WriteBuffer)
 	go func() {
 		for true {
 			conn, err := listener.AcceptKCP()
 			if err != nil {
-				log.Println("listen error", err)
-			} else {
-				log.Println("accept", conn.RemoteAddr())
-				conn.SetNoDelay(1, 30, 2, 1)
-				conn.SetReadBuffer(4096 * 1024)
-				conn.SetWriteBuffer(4096 * 1024)
-				conn.SetWindowSize(1024, 1024)
-				conn.SetACKNoDelay(true)
-				register(device, conn)
+				// listener is closed
+				log.Println(addr, "listen error", err)
+				break
 			}
+			log.Println("accept", conn.RemoteAddr())
+			cfg.Transport.KCP.Apply(conn)
+			register(device, sessions, auth, conn)
 		}
 	}()
+	return listener
+}
 
+// listenUDP listens on addr. An ipv4 or ipv6 address gets a socket of its
+// own family, so 0.0.0.0:9989 and [::]:9989 can be used together. An
+// address without host listens on both families.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp"
+	if udpAddr.IP.To4() != nil {
+		network = "udp4"
+	} else if udpAddr.IP != nil {
+		network = "udp6"
+	}
+	return net.ListenUDP(network, udpAddr)
 }
 
-func register(device *tun.Device, conn net.Conn) {
+func register(device *tun.Device, sessions *session.Manager, auth *authenticator, rawConn net.Conn) {
 	go func() {
+		conn, acc, ip, err := auth.authenticate(rawConn)
+		if err != nil {
+			log.Println(rawConn.RemoteAddr(), "authentication failed", err)
+			return
+		}
+		tunnel := proto.NewTunnel(conn.RemoteAddr().String(), conn)
+		tunnel.Timeout = cfg.Tunnel.Timeout.Duration
+		tunnel.IdleTimeout = cfg.Tunnel.IdleTimeout.Duration
+		s := session.NewSession(acc, ip, conn.RemoteAddr(), tunnel)
+		s.Release = func() {
+			auth.pool.Retire(ip)
+		}
+		if err := sessions.Add(s); err != nil {
+			log.Println(s.Name(), "rejected", err)
+			s.Close(err.Error())
+			return
+		}
+		log.Println(s.Name(), "connected with address", ip.String())
+		tunnel.StartKeepalive(cfg.Tunnel.Keepalive.Duration)
 		buf := make([]byte, 4096)
-		addr := uint32(0)
+		reason := ""
 		for true {
-			rc, err := conn.Read(buf)
+			rc, err := s.Read(buf)
 			if err != nil {
-				log.Println(conn.RemoteAddr(), "read error", err)
+				log.Println(s.Name(), "read error", err)
 				break
 			}
-			if addr == 0 {
-				ipp := tun.IPPacket(buf[:rc])
-				if err := ipp.Validate(); err != nil {
-					log.Println(conn.RemoteAddr(), "ip packet error")
-					break
-				}
-				sip := ipp.SrcIP()
-				addr = convertIP(sip)
-				_, ok := conns[addr]
-				if !ok {
-					log.Println("allow source ip", sip.String())
-					conns[addr] = conn
+			// account may be replaced by reloading
+			acc := s.Account()
+			ipp := tun.IPPacket(buf[:rc])
+			if ipp.Validate() != nil || !(ipp.SrcIP().Equal(ip) || acc.InSubnets(ipp.SrcIP())) || !acc.AllowRoute(ipp.DestIP()) {
+				// drop spoofed packets and packets to forbidden routes
+				s.Drop()
+				continue
+			}
+			if peer, ok := sessions.Lookup(ipp.DestIP()); ok {
+				if peer == s {
+					// packets to subnets behind itself
+					s.Drop()
 				} else {
-					log.Println("reject source ip", sip.String())
-					conn.Close()
-					break
+					forward(s, peer, buf[:rc])
 				}
+				continue
 			}
 			wc, err := device.Write(buf[:rc])
-			if err != nil {
-				log.Println(conn.RemoteAddr(), "write error", err)
-				break
+			if err == nil && wc != rc {
+				err = fmt.Errorf("read count: %d write count: %d", rc, wc)
 			}
-			if rc != wc {
-				log.Println(conn.RemoteAddr(), "broken connection", "read count:", rc, "write count:", wc)
+			if err != nil {
+				log.Println(s.Name(), "write error", err)
+				reason = "server tunnel device failed"
 				break
 			}
 		}
+		s.Close(reason)
+		stats := s.Stats()
+		log.Println(s.Name(), "disconnected after", time.Since(s.StartTime), "received", stats.RxBytes, "bytes, sent", stats.TxBytes, "bytes")
 	}()
 }
 
-func convertIP(ip net.IP) uint32 {
-	return binary.LittleEndian.Uint32(ip.To4())
+// forward forwards a packet from a session to another session directly
+func forward(from *session.Session, to *session.Session, packet []byte) {
+	if atomic.LoadInt32(&isolate) == 1 {
+		from.Drop()
+		return
+	}
+	// packet is reused by reader, so queue a copy
+	to.Enqueue(append([]byte(nil), packet...))
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestListenUDP(t *testing.T) {
+	if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skip("ipv6 is not available", err)
+	} else {
+		conn.Close()
+	}
+	for _, host := range []string{"0.0.0.0", "127.0.0.1"} {
+		v4, err := listenUDP(host + ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := v4.LocalAddr().(*net.UDPAddr).Port
+		v6, err := listenUDP(fmt.Sprintf("[::]:%d", port))
+		if err != nil {
+			v4.Close()
+			t.Fatalf("%s:%d and [::]:%d should be used together: %s", host, port, port, err)
+		}
+		v6.Close()
+		v4.Close()
+	}
+}
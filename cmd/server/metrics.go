@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/kdada/tinyvpn/pkg/metrics"
+	"github.com/kdada/tinyvpn/pkg/session"
+	"github.com/xtaci/kcp-go"
+)
+
+// collect writes kcp counters and counters of sessions
+func collect(sessions *session.Manager) func(w *metrics.Writer) {
+	return func(w *metrics.Writer) {
+		metrics.WriteSnmp(w, kcp.DefaultSnmp)
+		list := sessions.List()
+		w.Describe("tinyvpn_sessions", metrics.Gauge, "Count of connected sessions.")
+		w.Sample("tinyvpn_sessions", uint64(len(list)))
+		stats := make([]session.Stats, len(list))
+		for i, s := range list {
+			stats[i] = s.Stats()
+		}
+		for _, m := range []struct {
+			name  string
+			help  string
+			value func(stats *session.Stats) uint64
+		}{
+			{"tinyvpn_session_rx_packets_total", "Packets received from client.", func(s *session.Stats) uint64 { return s.RxPackets }},
+			{"tinyvpn_session_rx_bytes_total", "Bytes received from client.", func(s *session.Stats) uint64 { return s.RxBytes }},
+			{"tinyvpn_session_tx_packets_total", "Packets sent to client.", func(s *session.Stats) uint64 { return s.TxPackets }},
+			{"tinyvpn_session_tx_bytes_total", "Bytes sent to client.", func(s *session.Stats) uint64 { return s.TxBytes }},
+			{"tinyvpn_session_dropped_total", "Packets of client dropped by server.", func(s *session.Stats) uint64 { return s.Dropped }},
+		} {
+			w.Describe(m.name, metrics.Counter, m.help)
+			for i, s := range list {
+				w.Sample(m.name, m.value(&stats[i]), "account", s.Account().Name, "address", s.Address.String(), "remote", s.RemoteAddr.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/config"
+	"github.com/kdada/tinyvpn/pkg/proto"
+	"github.com/kdada/tinyvpn/pkg/session"
+	"github.com/kdada/tinyvpn/pkg/tun"
+)
+
+// reloader applies changes of config file and account file to live state.
+// Accounts, config pushed to clients, mtu and isolation can be reloaded,
+// other changes require a restart.
+type reloader struct {
+	sync.Mutex
+	// network is the route of tunnel
+	network *net.IPNet
+	// device is the tunnel device
+	device *tun.Device
+	// sessions contains all sessions
+	sessions *session.Manager
+	// auth holds accounts and the config pushed to clients
+	auth *authenticator
+}
+
+// reload reloads config and accounts. Sessions whose accounts are removed
+// or disabled are disconnected, and others get the new config.
+func (r *reloader) reload() error {
+	r.Lock()
+	defer r.Unlock()
+	log.Println("reloading config")
+	next := cfg
+	if configFile != "" {
+		c, err := config.LoadServer(configFile)
+		if err != nil {
+			return err
+		}
+		if ignored := restartRequired(cfg, c); len(ignored) > 0 {
+			log.Println("changes of", strings.Join(ignored, ", "), "are ignored, restart is required")
+		}
+		next = c
+	}
+	push, err := pushConfig(r.network, next)
+	if err != nil {
+		return err
+	}
+	old := subnets(r.auth.accounts.List())
+	if err := r.auth.accounts.Reload(); err != nil {
+		return err
+	}
+	r.auth.reserve()
+	if next.Tunnel.MTU > 0 && next.Tunnel.MTU != r.device.MTU {
+		if err := r.device.SetMTU(next.Tunnel.MTU); err != nil {
+			log.Println("can't change mtu", err)
+		} else {
+			log.Println("mtu is changed to", next.Tunnel.MTU)
+		}
+	}
+	// clients use the mtu of server device
+	push.MTU = uint16(r.device.MTU)
+	current := subnets(r.auth.accounts.List())
+	for name, subnet := range old {
+		if _, ok := current[name]; !ok {
+			if err := r.device.DeleteRoute(subnet); err != nil {
+				log.Println("can't delete subnet", name, err)
+			}
+		}
+	}
+	for name, subnet := range current {
+		if _, ok := old[name]; !ok {
+			if err := r.device.AddRoute(subnet); err != nil {
+				log.Println("can't add subnet", name, err)
+			}
+		}
+	}
+	if next.Tunnel.Isolate {
+		atomic.StoreInt32(&isolate, 1)
+	} else {
+		atomic.StoreInt32(&isolate, 0)
+	}
+	r.auth.lock.RLock()
+	changed := !reflect.DeepEqual(r.auth.config, push) || !reflect.DeepEqual(old, current)
+	r.auth.lock.RUnlock()
+	r.auth.setConfig(push)
+	r.update(changed)
+	log.Println("config reloaded")
+	return nil
+}
+
+// update replaces accounts of sessions, and pushes config to clients if
+// config is changed. Sessions whose addresses are not allowed or reserved
+// for other accounts are closed. Routes of accounts are checked for each
+// packet, so the new routes take effect immediately. Config is pushed in
+// background, so a stalled client can't block reloading.
+func (r *reloader) update(changed bool) {
+	for _, s := range r.sessions.List() {
+		acc, ok := r.auth.accounts.Get(s.Account().Name)
+		if !ok || !acc.Enabled {
+			log.Println(s.Name(), "disconnected because account is removed or disabled")
+			s.Close("account is removed or disabled")
+			continue
+		}
+		if !acc.AllowAddress(s.Address) || (len(acc.Addresses) == 0 && r.auth.pool.IsReserved(s.Address)) {
+			log.Println(s.Name(), "disconnected because address", s.Address.String(), "is not allowed")
+			s.Close("address is not allowed")
+			continue
+		}
+		if err := r.sessions.Update(s, acc); err != nil {
+			log.Println(s.Name(), "can't update account", err)
+			s.Close(err.Error())
+			continue
+		}
+		if changed {
+			go func(s *session.Session, push *proto.PushConfig) {
+				if err := s.Tunnel.Send(proto.TypeConfig, push); err != nil {
+					log.Println(s.Name(), "can't push config", err)
+				}
+			}(s, r.auth.configOf(acc))
+		}
+	}
+}
+
+// subnets returns subnets behind clients
+func subnets(accounts []*account.Account) map[string]*net.IPNet {
+	result := make(map[string]*net.IPNet)
+	for _, acc := range accounts {
+		for _, subnet := range acc.Networks() {
+			result[subnet.String()] = subnet
+		}
+	}
+	return result
+}
+
+// restartRequired returns the names of changed fields which can't be reloaded
+func restartRequired(old, new *config.Server) []string {
+	oldTunnel, newTunnel := old.Tunnel, new.Tunnel
+	oldTunnel.Isolate, newTunnel.Isolate = false, false
+	if new.Tunnel.MTU > 0 {
+		// mtu is changed by reloading, but the system default can't be restored
+		oldTunnel.MTU, newTunnel.MTU = 0, 0
+	}
+	result := make([]string, 0)
+	for _, field := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"listen", old.Listen, new.Listen},
+		{"transport", old.Transport, new.Transport},
+		{"tunnel", oldTunnel, newTunnel},
+		{"auth", old.Auth, new.Auth},
+		{"admin", old.Admin, new.Admin},
+		{"metrics", old.Metrics, new.Metrics},
+		{"shutdownTimeout", old.ShutdownTimeout, new.ShutdownTimeout},
+		{"log", old.Log, new.Log},
+	} {
+		if !reflect.DeepEqual(field.old, field.new) {
+			result = append(result, field.name)
+		}
+	}
+	return result
+}
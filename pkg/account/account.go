@@ -0,0 +1,239 @@
+package account
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Account describes a client account
+type Account struct {
+	// Name is the account name
+	Name string `json:"name"`
+	// SecretKey is used for encrypting auth data
+	SecretKey string `json:"secretKey"`
+	// Enabled shows whether the account can connect to server
+	Enabled bool `json:"enabled"`
+	// Addresses contains tunnel ips which the account can use.
+	// The account can use any ip if it's empty.
+	Addresses []string `json:"addresses"`
+	// Routes contains subnets which the account can access.
+	// The account can access any ip if it's empty.
+	Routes []string `json:"routes"`
+	// Subnets contains subnets behind the client. Packets to these subnets
+	// are routed to the client, and the client can send packets from them.
+	Subnets []string `json:"subnets"`
+
+	addresses []net.IP
+	routes    []*net.IPNet
+	subnets   []*net.IPNet
+}
+
+// Validate validates the account and parses its addresses, routes and subnets
+func (a *Account) Validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("account name is empty")
+	}
+	if len(a.Name) > 255 {
+		return fmt.Errorf("account name %s is too long", a.Name)
+	}
+	if a.SecretKey == "" {
+		return fmt.Errorf("account %s has no secret key", a.Name)
+	}
+	a.addresses = make([]net.IP, 0, len(a.Addresses))
+	for _, addr := range a.Addresses {
+		ip := net.ParseIP(addr).To4()
+		if ip == nil {
+			return fmt.Errorf("account %s has invalid address: %s", a.Name, addr)
+		}
+		a.addresses = append(a.addresses, ip)
+	}
+	a.routes = make([]*net.IPNet, 0, len(a.Routes))
+	for _, route := range a.Routes {
+		_, r, err := net.ParseCIDR(route)
+		if err != nil {
+			return fmt.Errorf("account %s has invalid route: %s", a.Name, route)
+		}
+		a.routes = append(a.routes, r)
+	}
+	a.subnets = make([]*net.IPNet, 0, len(a.Subnets))
+	for _, subnet := range a.Subnets {
+		_, r, err := net.ParseCIDR(subnet)
+		if err != nil || r.IP.To4() == nil {
+			return fmt.Errorf("account %s has invalid subnet: %s", a.Name, subnet)
+		}
+		a.subnets = append(a.subnets, r)
+	}
+	return nil
+}
+
+// Networks returns parsed subnets behind the client
+func (a *Account) Networks() []*net.IPNet {
+	return a.subnets
+}
+
+// InSubnets checks whether ip is in subnets behind the client
+func (a *Account) InSubnets(ip net.IP) bool {
+	for _, r := range a.subnets {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowAddress checks whether the account can use ip as its tunnel ip
+func (a *Account) AllowAddress(ip net.IP) bool {
+	if len(a.addresses) == 0 {
+		return true
+	}
+	for _, addr := range a.addresses {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowRoute checks whether the account can access ip
+func (a *Account) AllowRoute(ip net.IP) bool {
+	if len(a.routes) == 0 {
+		return true
+	}
+	for _, r := range a.routes {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store is a file-backed account store. The file looks like:
+//     {
+//       "accounts": [
+//         {
+//           "name": "alice",
+//           "secretKey": "secret",
+//           "enabled": true,
+//           "addresses": ["10.0.0.2"],
+//           "routes": ["10.0.0.0/24"],
+//           "subnets": ["192.168.1.0/24"]
+//         }
+//       ]
+//     }
+type Store struct {
+	sync.RWMutex
+	// Path is the path of account file
+	Path     string
+	accounts map[string]*Account
+	// disabled contains accounts disabled by SetEnabled
+	disabled map[string]bool
+}
+
+// NewStore loads accounts from file
+func NewStore(path string) (*Store, error) {
+	s := &Store{Path: path, disabled: make(map[string]bool)}
+	accounts, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	s.accounts = accounts
+	return s, nil
+}
+
+// load reads and validates accounts from file
+func load(path string) (map[string]*Account, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content := struct {
+		Accounts []*Account `json:"accounts"`
+	}{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&content); err != nil {
+		return nil, fmt.Errorf("can't parse account file %s: %s", path, err)
+	}
+	accounts := make(map[string]*Account, len(content.Accounts))
+	subnets := make(map[string]string)
+	for _, a := range content.Accounts {
+		if err := a.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := accounts[a.Name]; ok {
+			return nil, fmt.Errorf("duplicated account: %s", a.Name)
+		}
+		for _, r := range a.subnets {
+			if owner, ok := subnets[r.String()]; ok {
+				return nil, fmt.Errorf("subnet %s of account %s has been used by account %s", r.String(), a.Name, owner)
+			}
+			subnets[r.String()] = a.Name
+		}
+		accounts[a.Name] = a
+	}
+	return accounts, nil
+}
+
+// Reload reloads accounts from file. Accounts are not changed if the file
+// is invalid. Accounts disabled by SetEnabled are kept disabled, so a
+// revoked account can't come back by reloading.
+func (s *Store) Reload() error {
+	accounts, err := load(s.Path)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	for name := range s.disabled {
+		if a, ok := accounts[name]; ok {
+			a.Enabled = false
+		}
+	}
+	s.accounts = accounts
+	return nil
+}
+
+// List returns all accounts
+func (s *Store) List() []*Account {
+	s.RLock()
+	defer s.RUnlock()
+	result := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		result = append(result, a)
+	}
+	return result
+}
+
+// Get returns the account with name
+func (s *Store) Get(name string) (*Account, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	a, ok := s.accounts[name]
+	return a, ok
+}
+
+// SetEnabled enables or disables an account. It only changes the account in
+// memory, and the account file is not modified. A disabled account stays
+// disabled after reloading until it's enabled again.
+func (s *Store) SetEnabled(name string, enabled bool) error {
+	s.Lock()
+	defer s.Unlock()
+	a, ok := s.accounts[name]
+	if !ok {
+		return fmt.Errorf("unknown account: %s", name)
+	}
+	// accounts are shared with sessions, so replace it instead of modifying it
+	updated := *a
+	updated.Enabled = enabled
+	s.accounts[name] = &updated
+	if enabled {
+		delete(s.disabled, name)
+	} else {
+		s.disabled[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package account
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts.json")
+	data := `{"accounts": [
+		{"name": "alice", "secretKey": "a", "enabled": true, "addresses": ["10.0.0.2"], "routes": ["10.0.0.0/24"],
+		 "subnets": ["192.168.1.0/24"]},
+		{"name": "bob", "secretKey": "b"}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := s.Get("alice")
+	if !ok || !alice.Enabled {
+		t.Fatal("alice should be enabled")
+	}
+	if !alice.AllowAddress(net.ParseIP("10.0.0.2")) || alice.AllowAddress(net.ParseIP("10.0.0.3")) {
+		t.Fatal("alice should only use 10.0.0.2")
+	}
+	if !alice.AllowRoute(net.ParseIP("10.0.0.9")) || alice.AllowRoute(net.ParseIP("10.0.1.1")) {
+		t.Fatal("alice should only access 10.0.0.0/24")
+	}
+	if !alice.InSubnets(net.ParseIP("192.168.1.9")) || alice.InSubnets(net.ParseIP("192.168.2.1")) {
+		t.Fatal("alice should own 192.168.1.0/24")
+	}
+	bob, ok := s.Get("bob")
+	if !ok || bob.Enabled {
+		t.Fatal("bob should be disabled")
+	}
+	if !bob.AllowAddress(net.ParseIP("10.0.0.3")) || !bob.AllowRoute(net.ParseIP("10.0.1.1")) {
+		t.Fatal("bob should have no restriction")
+	}
+	if _, ok := s.Get("carol"); ok {
+		t.Fatal("carol should not exist")
+	}
+	if err := s.SetEnabled("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Get("alice"); a.Enabled || !alice.Enabled {
+		t.Fatal("alice should be disabled without modifying the old account")
+	}
+	if err := s.SetEnabled("carol", true); err == nil {
+		t.Fatal("carol should not be enabled")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Get("alice"); a.Enabled {
+		t.Fatal("alice should be kept disabled after reloaded")
+	}
+	if err := s.SetEnabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Get("alice"); !a.Enabled {
+		t.Fatal("alice should be enabled after enabled again")
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"accounts": [{"name": "carol", "secretKey": "c"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("carol"); !ok || len(s.List()) != 1 {
+		t.Fatal("only carol should exist after reloaded")
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"accounts": [{"name": "dave"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Fatal("invalid file should not be reloaded")
+	}
+	if _, ok := s.Get("carol"); !ok {
+		t.Fatal("carol should be kept if reloading failed")
+	}
+}
+
+func TestStoreInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts.json")
+	for _, data := range []string{
+		`{"accounts": [{"name": "alice"}]}`,
+		`{"accounts": [{"name": "alice", "secretKey": "a", "addresses": ["10.0.0"]}]}`,
+		`{"accounts": [{"name": "alice", "secretKey": "a", "routes": ["10.0.0.0"]}]}`,
+		`{"accounts": [{"name": "alice", "secretKey": "a"}, {"name": "alice", "secretKey": "b"}]}`,
+		`{"accounts": [{"name": "alice", "secret": "a"}]}`,
+		`{"accounts": [{"name": "alice", "secretKey": "a", "subnets": ["192.168.1.0/24"]},
+			{"name": "bob", "secretKey": "b", "subnets": ["192.168.1.0/24"]}]}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewStore(path); err == nil {
+			t.Fatalf("%s should be invalid", data)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/crypt"
+)
+
+// Client is the config of client. The file looks like:
+//     {
+//       "server": "22.22.22.22:9989",
+//       "transport": {"crypt": "aes", "key": "secret", "kcp": {"interval": 20}},
+//       "tunnel": {"keepalive": "10s", "timeout": "1m"},
+//       "fullTunnel": true,
+//       "killSwitch": {"enabled": true, "lan": ["192.168.1.0/24"]},
+//       "reconnect": {"minDelay": "1s", "maxDelay": "1m"},
+//       "auth": {"account": "alice", "secret": "secret"},
+//       "control": "/var/run/tinyvpn.sock",
+//       "log": {"file": "/var/log/tinyvpn.log"}
+//     }
+type Client struct {
+	// Server is the address of server
+	Server string `json:"server"`
+	// Transport contains crypt and kcp parameters
+	Transport Transport `json:"transport"`
+	// Tunnel contains timeouts of tunnel
+	Tunnel Tunnel `json:"tunnel"`
+	// FullTunnel sends all ipv4 traffic through the tunnel
+	FullTunnel bool `json:"fullTunnel"`
+	// KillSwitch blocks traffic out of the tunnel
+	KillSwitch KillSwitch `json:"killSwitch"`
+	// Reconnect contains delays of reconnection
+	Reconnect Reconnect `json:"reconnect"`
+	// Auth contains the account of client
+	Auth ClientAuth `json:"auth"`
+	// Control is the unix socket of control api, empty means disabled. The
+	// socket can only be accessed by the user running client.
+	Control string `json:"control"`
+	// Metrics is the address of prometheus metrics, empty means disabled
+	Metrics string `json:"metrics"`
+	// ShutdownTimeout is the max duration for stopping the tunnel when exiting
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// Log describes where logs are written
+	Log Log `json:"log"`
+}
+
+// Reconnect contains delays of reconnection. The delay grows exponentially
+// from MinDelay to MaxDelay with jitter.
+type Reconnect struct {
+	// MinDelay is the delay before the first reconnection
+	MinDelay Duration `json:"minDelay"`
+	// MaxDelay is the max delay between reconnections
+	MaxDelay Duration `json:"maxDelay"`
+}
+
+// Validate validates delays
+func (r *Reconnect) Validate() error {
+	if r.MinDelay.Duration <= 0 {
+		return fmt.Errorf("minDelay must be positive")
+	}
+	if r.MaxDelay.Duration < r.MinDelay.Duration {
+		return fmt.Errorf("maxDelay %s is shorter than minDelay %s", r.MaxDelay.Duration, r.MinDelay.Duration)
+	}
+	return nil
+}
+
+// KillSwitch blocks traffic out of the tunnel on linux, so traffic never
+// falls back to local network after the tunnel failed. Its rules are kept
+// while reconnecting and after the client crashed, and are removed when the
+// client exits normally, or by "nft delete table inet tinyvpn".
+type KillSwitch struct {
+	// Enabled enables the kill switch
+	Enabled bool `json:"enabled"`
+	// LAN contains local networks which can be accessed out of the tunnel
+	LAN []string `json:"lan"`
+}
+
+// Validate validates local networks
+func (k *KillSwitch) Validate() error {
+	for _, lan := range k.LAN {
+		if _, _, err := net.ParseCIDR(lan); err != nil {
+			return fmt.Errorf("lan: invalid network %q", lan)
+		}
+	}
+	return nil
+}
+
+// ClientAuth contains the account of client
+type ClientAuth struct {
+	// Account is the account name
+	Account string `json:"account"`
+	// Secret is the secret key of account
+	Secret string `json:"secret"`
+}
+
+// DefaultClient returns the default client config
+func DefaultClient() *Client {
+	return &Client{
+		Transport: Transport{Crypt: crypt.DefaultMethod, KCP: DefaultKCP()},
+		Tunnel:    defaultTunnel(),
+		Reconnect: Reconnect{
+			MinDelay: Duration{time.Second},
+			MaxDelay: Duration{time.Minute},
+		},
+		ShutdownTimeout: Duration{5 * time.Second},
+	}
+}
+
+// LoadClient loads and validates client config from file. Fields not in
+// the file have default values.
+func LoadClient(path string) (*Client, error) {
+	c := DefaultClient()
+	if err := load(path, c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// Validate validates client config
+func (c *Client) Validate() error {
+	if err := validateAddress(c.Server); err != nil {
+		return fmt.Errorf("server: %s", err)
+	}
+	if err := c.Transport.Validate(); err != nil {
+		return fmt.Errorf("transport: %s", err)
+	}
+	if err := c.Tunnel.Validate(); err != nil {
+		return fmt.Errorf("tunnel: %s", err)
+	}
+	if err := c.Reconnect.Validate(); err != nil {
+		return fmt.Errorf("reconnect: %s", err)
+	}
+	if err := c.KillSwitch.Validate(); err != nil {
+		return fmt.Errorf("killSwitch: %s", err)
+	}
+	if c.Auth.Account == "" || len(c.Auth.Account) > 255 {
+		return fmt.Errorf("auth: account name must have 1 to 255 bytes")
+	}
+	if c.Auth.Secret == "" {
+		return fmt.Errorf("auth: no secret key")
+	}
+	if c.Metrics != "" {
+		if err := validateAddress(c.Metrics); err != nil {
+			return fmt.Errorf("metrics: %s", err)
+		}
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("shutdownTimeout: duration can't be negative")
+	}
+	return nil
+}
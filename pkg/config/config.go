@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/crypt"
+	"github.com/kdada/tinyvpn/pkg/tun"
+	"github.com/xtaci/kcp-go"
+)
+
+// Duration is a duration written as a string like "10s" in config files
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON marshals duration to a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON unmarshals duration from a string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	value := ""
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %s", data)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// KCP contains parameters of kcp sessions. Client and server should use the
+// same shards.
+type KCP struct {
+	// NoDelay enables nodelay mode, 0 or 1
+	NoDelay int `json:"noDelay"`
+	// Interval is the interval of kcp updates in milliseconds
+	Interval int `json:"interval"`
+	// Resend enables fast resend after the count of ack skips, 0 means disabled
+	Resend int `json:"resend"`
+	// NoCongestion disables congestion control, 0 or 1
+	NoCongestion int `json:"noCongestion"`
+	// SendWindow is the send window size in packets
+	SendWindow int `json:"sendWindow"`
+	// RecvWindow is the receive window size in packets
+	RecvWindow int `json:"recvWindow"`
+	// DataShards is the count of fec data shards
+	DataShards int `json:"dataShards"`
+	// ParityShards is the count of fec parity shards
+	ParityShards int `json:"parityShards"`
+	// ReadBuffer is the socket read buffer size in bytes
+	ReadBuffer int `json:"readBuffer"`
+	// WriteBuffer is the socket write buffer size in bytes
+	WriteBuffer int `json:"writeBuffer"`
+	// AckNoDelay sends acks immediately
+	AckNoDelay bool `json:"ackNoDelay"`
+}
+
+// Validate validates kcp parameters
+func (k *KCP) Validate() error {
+	switch {
+	case k.NoDelay != 0 && k.NoDelay != 1:
+		return fmt.Errorf("noDelay must be 0 or 1: %d", k.NoDelay)
+	case k.Interval < 10 || k.Interval > 5000:
+		return fmt.Errorf("interval must be in [10, 5000]: %d", k.Interval)
+	case k.Resend < 0:
+		return fmt.Errorf("resend can't be negative: %d", k.Resend)
+	case k.NoCongestion != 0 && k.NoCongestion != 1:
+		return fmt.Errorf("noCongestion must be 0 or 1: %d", k.NoCongestion)
+	case k.SendWindow <= 0 || k.RecvWindow <= 0:
+		return fmt.Errorf("window sizes must be positive: %d, %d", k.SendWindow, k.RecvWindow)
+	case k.DataShards < 0 || k.ParityShards < 0:
+		return fmt.Errorf("shards can't be negative: %d, %d", k.DataShards, k.ParityShards)
+	case k.ParityShards > 0 && k.DataShards == 0:
+		return fmt.Errorf("parity shards require data shards")
+	case k.ReadBuffer <= 0 || k.WriteBuffer <= 0:
+		return fmt.Errorf("buffer sizes must be positive: %d, %d", k.ReadBuffer, k.WriteBuffer)
+	}
+	return nil
+}
+
+// Apply applies parameters to a kcp session
+func (k *KCP) Apply(conn *kcp.UDPSession) {
+	conn.SetNoDelay(k.NoDelay, k.Interval, k.Resend, k.NoCongestion)
+	conn.SetReadBuffer(k.ReadBuffer)
+	conn.SetWriteBuffer(k.WriteBuffer)
+	conn.SetWindowSize(k.SendWindow, k.RecvWindow)
+	conn.SetACKNoDelay(k.AckNoDelay)
+}
+
+// Transport describes how packets are carried between client and server
+type Transport struct {
+	// Crypt is the crypt method of kcp packets
+	Crypt string `json:"crypt"`
+	// Key is the pre-shared key of kcp packets
+	Key string `json:"key"`
+	// KCP contains kcp parameters
+	KCP KCP `json:"kcp"`
+}
+
+// Validate validates transport
+func (t *Transport) Validate() error {
+	if _, err := crypt.NewBlockCrypt(t.Crypt, t.Key); err != nil {
+		return err
+	}
+	if err := t.KCP.Validate(); err != nil {
+		return fmt.Errorf("kcp: %s", err)
+	}
+	return nil
+}
+
+// Tunnel contains timeouts of tunnels
+type Tunnel struct {
+	// Keepalive is the interval of keepalives, 0 means no keepalive
+	Keepalive Duration `json:"keepalive"`
+	// Timeout is the max duration without any frame from peer, 0 means no timeout
+	Timeout Duration `json:"timeout"`
+	// IdleTimeout is the max duration without any ip packet, it requires
+	// keepalive. 0 means no idle timeout.
+	IdleTimeout Duration `json:"idleTimeout"`
+}
+
+// Validate validates timeouts
+func (t *Tunnel) Validate() error {
+	if t.Keepalive.Duration < 0 || t.Timeout.Duration < 0 || t.IdleTimeout.Duration < 0 {
+		return fmt.Errorf("durations can't be negative")
+	}
+	if t.Timeout.Duration > 0 && t.Timeout.Duration <= t.Keepalive.Duration {
+		return fmt.Errorf("timeout %s must be longer than keepalive %s", t.Timeout.Duration, t.Keepalive.Duration)
+	}
+	if t.IdleTimeout.Duration > 0 && t.Keepalive.Duration == 0 {
+		// idle timeout is checked when sending keepalives
+		return fmt.Errorf("idleTimeout requires keepalive")
+	}
+	return nil
+}
+
+// Log describes where logs are written
+type Log struct {
+	// File is the path of log file. Logs are written to stderr if it's empty.
+	File string `json:"file"`
+}
+
+// Setup sets the output of standard logger
+func (l *Log) Setup() error {
+	if l.File == "" {
+		return nil
+	}
+	file, err := os.OpenFile(l.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(file)
+	return nil
+}
+
+// DefaultKCP returns default kcp parameters
+func DefaultKCP() KCP {
+	return KCP{
+		NoDelay:      1,
+		Interval:     30,
+		Resend:       2,
+		NoCongestion: 1,
+		SendWindow:   1024,
+		RecvWindow:   1024,
+		DataShards:   10,
+		ParityShards: 3,
+		ReadBuffer:   4096 * 1024,
+		WriteBuffer:  4096 * 1024,
+		AckNoDelay:   true,
+	}
+}
+
+// defaultTunnel returns default timeouts of tunnels
+func defaultTunnel() Tunnel {
+	return Tunnel{
+		Keepalive: Duration{10 * time.Second},
+		Timeout:   Duration{time.Minute},
+	}
+}
+
+// load reads a json config file into v. Fields not in the file keep their
+// values, and unknown fields are errors.
+func load(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("can't parse config file %s: %s", path, describe(data, err))
+	}
+	if decoder.More() {
+		return fmt.Errorf("can't parse config file %s: unexpected data after config", path)
+	}
+	return nil
+}
+
+// describe adds the line and column to errors with an offset
+func describe(data []byte, err error) string {
+	offset := int64(-1)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	}
+	if offset < 0 || offset > int64(len(data)) {
+		return err.Error()
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n') - 1
+	return fmt.Sprintf("line %d column %d: %s", line, column, err)
+}
+
+// validateAddress validates a host:port address
+func validateAddress(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid address %q: %s", addr, err)
+	}
+	return nil
+}
+
+// validateMTU validates mtu, 0 means system default
+func validateMTU(mtu int) error {
+	if mtu != 0 && (mtu < 68 || mtu > tun.MaxMTU) {
+		return fmt.Errorf("mtu must be 0 or in [68, %d]: %d", tun.MaxMTU, mtu)
+	}
+	return nil
+}
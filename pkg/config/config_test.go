@@ -0,0 +1,93 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server.json")
+	data := `{
+		"listen": ["0.0.0.0:9989", "[::]:9989", ":443"],
+		"transport": {"key": "secret", "kcp": {"interval": 20}},
+		"tunnel": {"local": "10.0.0.1", "remote": "10.0.0.2", "network": "10.0.0.0/24", "timeout": "30s"},
+		"auth": {"accounts": "accounts.json"}
+	}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listen) != 3 || c.Transport.KCP.Interval != 20 || c.Tunnel.Timeout.Duration != 30*time.Second {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	// defaults are kept
+	if c.Transport.KCP.DataShards != 10 || !c.Transport.KCP.AckNoDelay || c.Tunnel.Keepalive.Duration != 10*time.Second {
+		t.Fatalf("defaults are not kept: %+v", c)
+	}
+}
+
+func TestValidateListen(t *testing.T) {
+	for addrs, valid := range map[string]bool{
+		"0.0.0.0:9989,[::]:9989,:443":  true,
+		"127.0.0.1:9989,10.0.0.1:9989": true,
+		":9989,[::]:9989":              false,
+		"[::]:9989,:9989":              false,
+		"0.0.0.0:9989,0.0.0.0:9989":    false,
+	} {
+		err := validateListen(strings.Split(addrs, ","))
+		if (err == nil) != valid {
+			t.Fatalf("validation of %s should be %v, but got %v", addrs, valid, err)
+		}
+	}
+}
+
+func TestValidateMTU(t *testing.T) {
+	for mtu, valid := range map[int]bool{0: true, 68: true, 1400: true, 4000: true, 67: false, 4001: false, 9000: false} {
+		err := validateMTU(mtu)
+		if (err == nil) != valid {
+			t.Fatalf("validation of mtu %d should be %v, but got %v", mtu, valid, err)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "client.json")
+	base := `{"server": ":9989", "auth": {"account": "a", "secret": "s"}, `
+	for data, message := range map[string]string{
+		base + `"key": "k"}`: `unknown field "key"`,
+		base + "\n" + `"transport": {"kcp": {"interval": "1"}}}`:                                "line 2",
+		base + `"tunnel": {"timeout": 1}}`:                                                      "duration must be a string",
+		base + `"transport": {"key": "k"}, "tunnel": {"timeout": "5s"}}`:                        "tunnel: timeout",
+		base + `"transport": {"key": "k"}, "tunnel": {"keepalive": "0s", "idleTimeout": "5m"}}`: "tunnel: idleTimeout",
+		base + `"transport": {"key": "k", "crypt": "rot13"}}`:                                   "transport:",
+		base + `"transport": {"key": "k", "kcp": {"noDelay": 2}}}`:                              "transport: kcp: noDelay",
+		base + `"transport": {"key": "k"}, "killSwitch": {"lan": ["10.0.0.1"]}}`:                "killSwitch: lan",
+		`{"server": "9989", "auth": {"account": "a", "secret": "s"}}`:                           "server:",
+		`{"server": ":9989", "transport": {"key": "k"}, "auth": {"account": "a"}}`:              "auth:",
+	} {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadClient(path)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Fatalf("%s should fail with %q, but got %v", data, message, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/crypt"
+)
+
+// Server is the config of server. The file looks like:
+//     {
+//       "listen": ["0.0.0.0:9989", "[::]:9989"],
+//       "transport": {"crypt": "aes", "key": "secret", "kcp": {"interval": 20}},
+//       "tunnel": {"local": "10.0.0.1", "remote": "10.0.0.2", "network": "10.0.0.0/24", "mtu": 1400,
+//                  "keepalive": "10s", "timeout": "1m"},
+//       "push": {"routes": ["192.168.1.0/24"], "dns": ["10.0.0.1"], "searchDomains": ["corp.example.com"]},
+//       "auth": {"accounts": "/etc/tinyvpn/accounts.json", "clockSkew": "5m"},
+//       "admin": "127.0.0.1:9990",
+//       "metrics": "127.0.0.1:9991",
+//       "log": {"file": "/var/log/tinyvpn.log"}
+//     }
+type Server struct {
+	// Listen contains addresses for accepting clients
+	Listen []string `json:"listen"`
+	// Transport contains crypt and kcp parameters
+	Transport Transport `json:"transport"`
+	// Tunnel contains addresses and timeouts of tunnels
+	Tunnel ServerTunnel `json:"tunnel"`
+	// Push contains the config pushed to clients
+	Push Push `json:"push"`
+	// Auth contains authentication settings
+	Auth ServerAuth `json:"auth"`
+	// Admin is the loopback address of admin api, empty means disabled
+	Admin string `json:"admin"`
+	// Metrics is the address of prometheus metrics, empty means disabled
+	Metrics string `json:"metrics"`
+	// ShutdownTimeout is the max duration for disconnecting clients when exiting
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// Log describes where logs are written
+	Log Log `json:"log"`
+}
+
+// ServerTunnel contains addresses and timeouts of tunnels on server
+type ServerTunnel struct {
+	Tunnel
+	// Local is the local ip of tunnel device
+	Local string `json:"local"`
+	// Remote is the remote ip of tunnel device
+	Remote string `json:"remote"`
+	// Network is the route of tunnel and the address pool of clients
+	Network string `json:"network"`
+	// MTU is the mtu of tunnel devices, at most 4000, 0 means system default
+	MTU int `json:"mtu"`
+	// Isolate drops traffic between clients
+	Isolate bool `json:"isolate"`
+}
+
+// Push contains the config pushed to clients
+type Push struct {
+	// Routes contains extra routes
+	Routes []string `json:"routes"`
+	// DNS contains dns servers
+	DNS []string `json:"dns"`
+	// SearchDomains contains dns search domains
+	SearchDomains []string `json:"searchDomains"`
+}
+
+// ServerAuth contains authentication settings
+type ServerAuth struct {
+	// Accounts is the path of account file
+	Accounts string `json:"accounts"`
+	// ClockSkew is the max clock skew between clients and server
+	ClockSkew Duration `json:"clockSkew"`
+	// ReplayCache is the max count of authentications remembered for replay detection
+	ReplayCache int `json:"replayCache"`
+}
+
+// DefaultServer returns the default server config
+func DefaultServer() *Server {
+	return &Server{
+		Listen:    make([]string, 0),
+		Transport: Transport{Crypt: crypt.DefaultMethod, KCP: DefaultKCP()},
+		Tunnel:    ServerTunnel{Tunnel: defaultTunnel()},
+		Push: Push{
+			Routes:        make([]string, 0),
+			DNS:           make([]string, 0),
+			SearchDomains: make([]string, 0),
+		},
+		Auth: ServerAuth{
+			ClockSkew:   Duration{5 * time.Minute},
+			ReplayCache: 65536,
+		},
+		ShutdownTimeout: Duration{5 * time.Second},
+	}
+}
+
+// LoadServer loads and validates server config from file. Fields not in
+// the file have default values.
+func LoadServer(path string) (*Server, error) {
+	c := DefaultServer()
+	if err := load(path, c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// Validate validates server config
+func (c *Server) Validate() error {
+	if len(c.Listen) <= 0 {
+		return fmt.Errorf("listen: no listen address")
+	}
+	if err := validateListen(c.Listen); err != nil {
+		return fmt.Errorf("listen: %s", err)
+	}
+	if err := c.Transport.Validate(); err != nil {
+		return fmt.Errorf("transport: %s", err)
+	}
+	if err := c.Tunnel.Validate(); err != nil {
+		return fmt.Errorf("tunnel: %s", err)
+	}
+	if err := c.Push.Validate(); err != nil {
+		return fmt.Errorf("push: %s", err)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %s", err)
+	}
+	for name, addr := range map[string]string{"admin": c.Admin, "metrics": c.Metrics} {
+		if addr == "" {
+			continue
+		}
+		if err := validateAddress(addr); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("shutdownTimeout: duration can't be negative")
+	}
+	return nil
+}
+
+// validateListen validates listen addresses. An address without host
+// listens on ipv4 and ipv6, so its port can't be used by other addresses.
+func validateListen(addrs []string) error {
+	hosts := make(map[string][]string)
+	for _, addr := range addrs {
+		if err := validateAddress(addr); err != nil {
+			return err
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		for _, h := range hosts[port] {
+			if h == host || h == "" || host == "" {
+				return fmt.Errorf("address %q conflicts with %q", addr, net.JoinHostPort(h, port))
+			}
+		}
+		hosts[port] = append(hosts[port], host)
+	}
+	return nil
+}
+
+// Validate validates addresses and timeouts of tunnels
+func (t *ServerTunnel) Validate() error {
+	for name, addr := range map[string]string{"local": t.Local, "remote": t.Remote} {
+		if net.ParseIP(addr).To4() == nil {
+			return fmt.Errorf("%s: invalid ipv4 address %q", name, addr)
+		}
+	}
+	_, network, err := net.ParseCIDR(t.Network)
+	if err != nil || network.IP.To4() == nil {
+		return fmt.Errorf("network: invalid ipv4 network %q", t.Network)
+	}
+	if err := validateMTU(t.MTU); err != nil {
+		return err
+	}
+	return t.Tunnel.Validate()
+}
+
+// Validate validates the config pushed to clients
+func (p *Push) Validate() error {
+	for _, route := range p.Routes {
+		if _, _, err := net.ParseCIDR(route); err != nil {
+			return fmt.Errorf("routes: invalid route %q", route)
+		}
+	}
+	for _, dns := range p.DNS {
+		if net.ParseIP(dns).To4() == nil {
+			return fmt.Errorf("dns: invalid dns server %q", dns)
+		}
+	}
+	for _, domain := range p.SearchDomains {
+		if domain == "" || len(domain) > 255 || strings.ContainsAny(domain, " \t\n,") {
+			return fmt.Errorf("searchDomains: invalid domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// Validate validates authentication settings
+func (a *ServerAuth) Validate() error {
+	if a.Accounts == "" {
+		return fmt.Errorf("accounts: no account file")
+	}
+	if a.ClockSkew.Duration <= 0 {
+		return fmt.Errorf("clockSkew: duration must be positive")
+	}
+	if a.ReplayCache <= 0 {
+		return fmt.Errorf("replayCache: capacity must be positive")
+	}
+	return nil
+}
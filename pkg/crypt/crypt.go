@@ -0,0 +1,63 @@
+package crypt
+
+import (
+	"crypto/sha1"
+	"fmt"
+
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// salt is used for deriving keys from pre-shared keys
+const salt = "tinyvpn"
+
+// DefaultMethod is the default crypt method of tunnel
+const DefaultMethod = "aes"
+
+// DeriveKey derives a 32 bytes key from a pre-shared key
+func DeriveKey(key string) []byte {
+	return pbkdf2.Key([]byte(key), []byte(salt), 4096, 32, sha1.New)
+}
+
+// Methods returns all supported crypt methods
+func Methods() []string {
+	return []string{"aes", "aes-128", "aes-192", "salsa20", "blowfish", "twofish",
+		"cast5", "3des", "tea", "xtea", "xor", "none"}
+}
+
+// NewBlockCrypt creates a block crypt via method and pre-shared key.
+// Peers with different keys can't decrypt packets of each other, and kcp
+// drops these packets because of checksum errors.
+func NewBlockCrypt(method string, key string) (kcp.BlockCrypt, error) {
+	if key == "" && method != "none" {
+		return nil, fmt.Errorf("crypt method %s requires a key", method)
+	}
+	pass := DeriveKey(key)
+	switch method {
+	case "aes":
+		return kcp.NewAESBlockCrypt(pass)
+	case "aes-128":
+		return kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		return kcp.NewAESBlockCrypt(pass[:24])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(pass)
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "tea":
+		return kcp.NewTEABlockCrypt(pass[:16])
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(pass[:16])
+	case "xor":
+		return kcp.NewSimpleXORBlockCrypt(pass)
+	case "none":
+		return kcp.NewNoneBlockCrypt(pass)
+	}
+	return nil, fmt.Errorf("unknown crypt method: %s", method)
+}
@@ -0,0 +1,49 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlockCrypt(t *testing.T) {
+	data := []byte("0123456789abcdef0123456789abcdef0123456789abcdef")
+	for _, method := range Methods() {
+		block, err := NewBlockCrypt(method, "key")
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		encrypted := make([]byte, len(data))
+		block.Encrypt(encrypted, data)
+		decrypted := make([]byte, len(data))
+		block.Decrypt(decrypted, encrypted)
+		if !bytes.Equal(decrypted, data) {
+			t.Fatalf("%s: decrypted data should be the same as the original", method)
+		}
+		if method == "none" {
+			continue
+		}
+		if bytes.Equal(encrypted, data) {
+			t.Fatalf("%s: data should be encrypted", method)
+		}
+		other, err := NewBlockCrypt(method, "other key")
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		other.Decrypt(decrypted, encrypted)
+		if bytes.Equal(decrypted, data) {
+			t.Fatalf("%s: data should not be decrypted with a mismatched key", method)
+		}
+	}
+}
+
+func TestBlockCryptInvalid(t *testing.T) {
+	if _, err := NewBlockCrypt("rot13", "key"); err == nil {
+		t.Fatal("unknown method should fail")
+	}
+	if _, err := NewBlockCrypt(DefaultMethod, ""); err == nil {
+		t.Fatal("empty key should fail")
+	}
+	if _, err := NewBlockCrypt("none", ""); err != nil {
+		t.Fatal("method none should not require a key", err)
+	}
+}
@@ -0,0 +1,14 @@
+package dns
+
+import "net"
+
+// Manager applies dns servers and search domains of a tunnel device to
+// system, and reverts them when the tunnel is gone.
+type Manager interface {
+	// Set replaces the dns settings of device. Settings are reverted if
+	// both servers and domains are empty.
+	Set(servers []net.IP, domains []string) error
+	// Revert restores the original dns settings. It does nothing if
+	// nothing was set.
+	Revert() error
+}
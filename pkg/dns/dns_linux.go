@@ -0,0 +1,63 @@
+// +build linux
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// New creates a dns manager of device. Per-link settings of
+// systemd-resolved are used if it's running, otherwise resolv.conf is
+// replaced.
+func New(device string) Manager {
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		if _, err := os.Stat("/run/systemd/resolve/io.systemd.Resolve"); err == nil {
+			return &resolved{device: device}
+		}
+	}
+	return &resolvConf{path: resolvConfPath, backup: resolvConfPath + ".tinyvpn"}
+}
+
+// resolved sets dns of device via systemd-resolved
+type resolved struct {
+	device string
+	set    bool
+}
+
+// Set sets per-link dns servers and search domains of device
+func (r *resolved) Set(servers []net.IP, domains []string) error {
+	if len(servers) == 0 && len(domains) == 0 {
+		return r.Revert()
+	}
+	args := []string{"dns", r.device}
+	for _, ip := range servers {
+		args = append(args, ip.String())
+	}
+	if err := resolvectl(args...); err != nil {
+		return err
+	}
+	r.set = true
+	return resolvectl(append([]string{"domain", r.device}, domains...)...)
+}
+
+// Revert drops per-link settings of device
+func (r *resolved) Revert() error {
+	if !r.set {
+		return nil
+	}
+	r.set = false
+	return resolvectl("revert", r.device)
+}
+
+// resolvectl runs resolvectl with args
+func resolvectl(args ...string) error {
+	output, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvectl %s: %s %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+// +build !linux
+
+package dns
+
+import (
+	"fmt"
+	"net"
+)
+
+// New creates a dns manager of device. Dns settings are not supported on
+// this platform.
+func New(device string) Manager {
+	return unsupported{}
+}
+
+// unsupported is a manager which can't set anything
+type unsupported struct{}
+
+// Set returns an error unless servers and domains are empty
+func (unsupported) Set(servers []net.IP, domains []string) error {
+	if len(servers) == 0 && len(domains) == 0 {
+		return nil
+	}
+	return fmt.Errorf("dns settings are not supported on this platform")
+}
+
+// Revert does nothing
+func (unsupported) Revert() error {
+	return nil
+}
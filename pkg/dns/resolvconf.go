@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// resolvConfPath is the path of resolver config
+const resolvConfPath = "/etc/resolv.conf"
+
+// resolvConf manages dns by replacing resolv.conf. The original file is
+// saved as backup and restored when reverting. A symlink is moved to backup
+// and a regular file is copied, because resolv.conf may be a mount point
+// in containers. A backup left by a crashed client is treated as the
+// original file.
+type resolvConf struct {
+	path   string
+	backup string
+	set    bool
+}
+
+// Set writes a resolv.conf with servers and domains. Options of the
+// original file are kept.
+func (r *resolvConf) Set(servers []net.IP, domains []string) error {
+	if len(servers) == 0 && len(domains) == 0 {
+		return r.Revert()
+	}
+	if !r.set {
+		if _, err := os.Lstat(r.backup); os.IsNotExist(err) {
+			if err := save(r.path, r.backup); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		r.set = true
+	}
+	original, err := ioutil.ReadFile(r.backup)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(r.path, generate(original, servers, domains), 0644)
+}
+
+// Revert restores the original file. The generated file is removed if
+// there was no original file.
+func (r *resolvConf) Revert() error {
+	if !r.set {
+		return nil
+	}
+	r.set = false
+	info, err := os.Lstat(r.backup)
+	if os.IsNotExist(err) {
+		return os.Remove(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return os.Rename(r.backup, r.path)
+	}
+	data, err := ioutil.ReadFile(r.backup)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.path, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(r.backup)
+}
+
+// save saves file at path to backup. It does nothing if there is no file.
+func save(path, backup string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return os.Rename(path, backup)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(backup, data, info.Mode().Perm())
+}
+
+// generate generates a resolv.conf. Servers and domains go before those of
+// the original file, and original servers are used only if servers is
+// empty.
+func generate(original []byte, servers []net.IP, domains []string) []byte {
+	var nameservers, searches, others []string
+	for _, ip := range servers {
+		nameservers = append(nameservers, ip.String())
+	}
+	searches = append(searches, domains...)
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(servers) == 0 && len(fields) > 1 {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "search", "domain":
+			searches = append(searches, fields[1:]...)
+		default:
+			others = append(others, line)
+		}
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("# generated by tinyvpn, the original file is restored after tinyvpn exited\n")
+	for _, ns := range nameservers {
+		buf.WriteString("nameserver " + ns + "\n")
+	}
+	if len(searches) > 0 {
+		buf.WriteString("search " + strings.Join(searches, " ") + "\n")
+	}
+	for _, line := range others {
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
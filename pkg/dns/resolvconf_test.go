@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	original := "# comment\nnameserver 8.8.8.8\nsearch example.com\noptions edns0\n"
+	data := generate([]byte(original), []net.IP{net.ParseIP("10.0.0.1")}, []string{"corp.example.com"})
+	expected := "# generated by tinyvpn, the original file is restored after tinyvpn exited\n" +
+		"nameserver 10.0.0.1\nsearch corp.example.com example.com\noptions edns0\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected resolv.conf: %q", data)
+	}
+	data = generate([]byte(original), nil, []string{"corp.example.com"})
+	expected = "# generated by tinyvpn, the original file is restored after tinyvpn exited\n" +
+		"nameserver 8.8.8.8\nsearch corp.example.com example.com\noptions edns0\n"
+	if string(data) != expected {
+		t.Fatalf("original servers should be kept: %q", data)
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(path, []byte("nameserver 8.8.8.8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &resolvConf{path: path, backup: path + ".tinyvpn"}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := r.Set([]net.IP{net.ParseIP(ip)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(generate([]byte("nameserver 8.8.8.8\n"), []net.IP{net.ParseIP(ip)}, nil)) != string(data) {
+			t.Fatalf("unexpected resolv.conf: %q", data)
+		}
+	}
+	if err := r.Revert(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "nameserver 8.8.8.8\n" {
+		t.Fatalf("resolv.conf should be restored: %q", data)
+	}
+	if _, err := os.Stat(r.backup); !os.IsNotExist(err) {
+		t.Fatal("backup should be removed")
+	}
+	if err := r.Revert(); err != nil {
+		t.Fatal("revert twice should do nothing")
+	}
+
+	target := filepath.Join(dir, "stub.conf")
+	if err := os.Rename(path, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Set(nil, []string{"corp.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Revert(); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(path); err != nil || link != target {
+		t.Fatal("symlink should be restored")
+	}
+}
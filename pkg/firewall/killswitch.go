@@ -0,0 +1,60 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// table is the nftables table of kill switch
+const table = "tinyvpn"
+
+// KillSwitch blocks all traffic except traffic through the tunnel device,
+// to vpn server, on loopback and to local networks. Rules are kept until
+// Disable is called, so nothing leaks while the client is reconnecting or
+// after it crashed.
+type KillSwitch struct {
+	// Server is the endpoint of vpn server
+	Server *net.UDPAddr
+	// LAN contains local networks which are allowed
+	LAN []*net.IPNet
+}
+
+// ruleset returns a nftables script which replaces the table of kill
+// switch atomically. Traffic through device is allowed if device is not
+// empty.
+func (k *KillSwitch) ruleset(device string) string {
+	buf := &bytes.Buffer{}
+	// add an empty table first, so deleting never fails
+	fmt.Fprintf(buf, "add table inet %s\n", table)
+	fmt.Fprintf(buf, "delete table inet %s\n", table)
+	fmt.Fprintf(buf, "table inet %s {\n", table)
+	for _, c := range []struct {
+		name, hook, iface, addr, port string
+	}{
+		{"input", "input", "iifname", "saddr", "sport"},
+		{"output", "output", "oifname", "daddr", "dport"},
+	} {
+		fmt.Fprintf(buf, "\tchain %s {\n", c.name)
+		fmt.Fprintf(buf, "\t\ttype filter hook %s priority 0; policy drop;\n", c.hook)
+		fmt.Fprintf(buf, "\t\t%s \"lo\" accept\n", c.iface)
+		if device != "" {
+			fmt.Fprintf(buf, "\t\t%s %q accept\n", c.iface, device)
+		}
+		fmt.Fprintf(buf, "\t\t%s %s %s udp %s %d accept\n", family(k.Server.IP), c.addr, k.Server.IP.String(), c.port, k.Server.Port)
+		for _, lan := range k.LAN {
+			fmt.Fprintf(buf, "\t\t%s %s %s accept\n", family(lan.IP), c.addr, lan.String())
+		}
+		fmt.Fprintf(buf, "\t}\n")
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
+
+// family returns the nftables address family of ip
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
@@ -0,0 +1,32 @@
+// +build linux
+
+package firewall
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Enable installs rules of kill switch via nftables, and replaces the old
+// rules if they exist. Traffic through device is allowed if device is not
+// empty.
+func (k *KillSwitch) Enable(device string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(k.ruleset(device))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("can't install kill switch rules: %s %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Disable removes rules of kill switch. It does nothing if there is no
+// rule.
+func (k *KillSwitch) Disable() error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add table inet %s\ndelete table inet %s\n", table, table))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("can't remove kill switch rules: %s %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
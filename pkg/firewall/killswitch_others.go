@@ -0,0 +1,15 @@
+// +build !linux
+
+package firewall
+
+import "fmt"
+
+// Enable returns an error because kill switch is only supported on linux
+func (k *KillSwitch) Enable(device string) error {
+	return fmt.Errorf("kill switch is only supported on linux")
+}
+
+// Disable does nothing
+func (k *KillSwitch) Disable() error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRuleset(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	k := &KillSwitch{
+		Server: &net.UDPAddr{IP: net.ParseIP("22.22.22.22"), Port: 9989},
+		LAN:    []*net.IPNet{lan},
+	}
+	expected := `add table inet tinyvpn
+delete table inet tinyvpn
+table inet tinyvpn {
+	chain input {
+		type filter hook input priority 0; policy drop;
+		iifname "lo" accept
+		iifname "tun0" accept
+		ip saddr 22.22.22.22 udp sport 9989 accept
+		ip saddr 192.168.1.0/24 accept
+	}
+	chain output {
+		type filter hook output priority 0; policy drop;
+		oifname "lo" accept
+		oifname "tun0" accept
+		ip daddr 22.22.22.22 udp dport 9989 accept
+		ip daddr 192.168.1.0/24 accept
+	}
+}
+`
+	if rules := k.ruleset("tun0"); rules != expected {
+		t.Fatalf("unexpected ruleset:\n%s", rules)
+	}
+	k = &KillSwitch{Server: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}}
+	expected = `add table inet tinyvpn
+delete table inet tinyvpn
+table inet tinyvpn {
+	chain input {
+		type filter hook input priority 0; policy drop;
+		iifname "lo" accept
+		ip6 saddr 2001:db8::1 udp sport 443 accept
+	}
+	chain output {
+		type filter hook output priority 0; policy drop;
+		oifname "lo" accept
+		ip6 daddr 2001:db8::1 udp dport 443 accept
+	}
+}
+`
+	if rules := k.ruleset(""); rules != expected {
+		t.Fatalf("unexpected ruleset without device:\n%s", rules)
+	}
+}
@@ -15,22 +15,35 @@ type IPAM struct {
 	sync.Mutex
 	Range net.IPNet
 	Last  net.IP
-	Pool  []net.IP
+	Used  map[uint32]bool
+	// Reserved contains IPs which are never assigned by Assign,
+	// but they can be acquired.
+	Reserved map[uint32]bool
+	first    uint32
+	last     uint32
 }
 
 // NewIPAM creates an IPAM to manage a scope of IPv4.
 // The scope should have more IPs than one. Otherwise It will
-// throw an error.
+// throw an error. The network address and broadcast address
+// of the scope are never assigned.
 func NewIPAM(scope net.IPNet) (*IPAM, error) {
 	ones, bits := scope.Mask.Size()
+	if bits != 32 {
+		return nil, fmt.Errorf("only IPv4 scope is supported")
+	}
 	if ones >= bits-1 {
 		return nil, fmt.Errorf("there is no IP to manage")
 	}
 	scopeIP := scope.IP.Mask(scope.Mask)
+	first := ConvertIPToInt(scopeIP.To4())
 	return &IPAM{
-		Range: scope,
-		Last:  scope.IP.Mask(scope.Mask),
-		Pool:  make([]net.IP, 0, 10),
+		Range:    scope,
+		Last:     scopeIP,
+		Used:     make(map[uint32]bool),
+		Reserved: make(map[uint32]bool),
+		first:    first + 1,
+		last:     first | (1<<uint(bits-ones) - 1) - 1,
 	}, nil
 }
 
@@ -39,22 +52,75 @@ func NewIPAM(scope net.IPNet) (*IPAM, error) {
 func (m *IPAM) Assign() (net.IP, error) {
 	m.Lock()
 	defer m.Unlock()
-	if len(m.Pool) > 0 {
-		ip := m.Pool[0]
-		m.Pool = m.Pool[1:]
-		return ip
-	}
 	value := ConvertIPToInt(m.Last.To4())
-	value++
-	ip := ConvertIntToIP(value)
-	return ip, nil
+	for i := m.first; i <= m.last; i++ {
+		value++
+		if value < m.first || value > m.last {
+			value = m.first
+		}
+		if !m.Used[value] && !m.Reserved[value] {
+			m.Used[value] = true
+			ip := ConvertIntToIP(value)
+			m.Last = ip
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no available IP in %s", m.Range.String())
+}
+
+// Acquire marks a specified IP as used. It returns an error if the IP
+// is not in range or has been used.
+func (m *IPAM) Acquire(ip net.IP) error {
+	m.Lock()
+	defer m.Unlock()
+	ip = ip.To4()
+	if ip == nil {
+		return fmt.Errorf("only IPv4 is supported")
+	}
+	value := ConvertIPToInt(ip)
+	if value < m.first || value > m.last {
+		return fmt.Errorf("IP %s is out of range %s", ip.String(), m.Range.String())
+	}
+	if m.Used[value] {
+		return fmt.Errorf("IP %s has been used", ip.String())
+	}
+	m.Used[value] = true
+	return nil
+}
+
+// Reserve replaces reserved IPs. Non-IPv4 IPs are ignored.
+func (m *IPAM) Reserve(ips []net.IP) {
+	m.Lock()
+	defer m.Unlock()
+	m.Reserved = make(map[uint32]bool, len(ips))
+	for _, ip := range ips {
+		if ip = ip.To4(); ip != nil {
+			m.Reserved[ConvertIPToInt(ip)] = true
+		}
+	}
+}
+
+// IsReserved checks whether ip is reserved
+func (m *IPAM) IsReserved(ip net.IP) bool {
+	m.Lock()
+	defer m.Unlock()
+	ip = ip.To4()
+	return ip != nil && m.Reserved[ConvertIPToInt(ip)]
 }
 
 // Retire recycles an IP
 func (m *IPAM) Retire(ip net.IP) error {
 	m.Lock()
 	defer m.Unlock()
-	m.Pool = append(m.Pool, ip)
+	ip = ip.To4()
+	if ip == nil {
+		return fmt.Errorf("only IPv4 is supported")
+	}
+	value := ConvertIPToInt(ip)
+	if !m.Used[value] {
+		return fmt.Errorf("IP %s is not used", ip.String())
+	}
+	delete(m.Used, value)
 	return nil
 }
 
@@ -70,7 +136,7 @@ func ConvertIntToIP(v uint32) net.IP {
 
 // ConvertIPToInt converts ip to int value
 func ConvertIPToInt(ip net.IP) uint32 {
-	value := 0
+	value := uint32(0)
 	for i := 0; i < 4; i++ {
 		value = value<<8 | uint32(ip[i])
 	}
@@ -0,0 +1,76 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPAM(t *testing.T) {
+	_, scope, _ := net.ParseCIDR("10.0.0.0/29")
+	m, err := NewIPAM(*scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Acquire(net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Acquire(net.ParseIP("10.0.0.1")); err == nil {
+		t.Fatal("used ip should not be acquired")
+	}
+	if err := m.Acquire(net.ParseIP("10.0.0.7")); err == nil {
+		t.Fatal("broadcast ip should not be acquired")
+	}
+	expects := []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}
+	for _, expect := range expects {
+		ip, err := m.Assign()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != expect {
+			t.Fatalf("ip should be %s, but got %s", expect, ip)
+		}
+	}
+	if _, err := m.Assign(); err == nil {
+		t.Fatal("ips should be exhausted")
+	}
+	if err := m.Retire(net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := m.Assign()
+	if err != nil || ip.String() != "10.0.0.3" {
+		t.Fatalf("ip should be 10.0.0.3, but got %s, %v", ip, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	_, scope, _ := net.ParseCIDR("10.0.0.0/29")
+	m, err := NewIPAM(*scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Reserve([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.3")})
+	if !m.IsReserved(net.ParseIP("10.0.0.3")) || m.IsReserved(net.ParseIP("10.0.0.2")) {
+		t.Fatal("only 10.0.0.1 and 10.0.0.3 should be reserved")
+	}
+	expects := []string{"10.0.0.2", "10.0.0.4", "10.0.0.5", "10.0.0.6"}
+	for _, expect := range expects {
+		ip, err := m.Assign()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != expect {
+			t.Fatalf("ip should be %s, but got %s", expect, ip)
+		}
+	}
+	if _, err := m.Assign(); err == nil {
+		t.Fatal("reserved ips should not be assigned")
+	}
+	if err := m.Acquire(net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal("reserved ip should be acquired", err)
+	}
+	m.Reserve([]net.IP{net.ParseIP("10.0.0.3")})
+	ip, err := m.Assign()
+	if err != nil || ip.String() != "10.0.0.1" {
+		t.Fatalf("ip should be 10.0.0.1 after it's not reserved, but got %s, %v", ip, err)
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// Metric types
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// Writer writes metrics in prometheus text format. Samples of a metric
+// must be written right after its description.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter creates a metric writer
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Err returns the first error of writing
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// printf writes a line and remembers the first error
+func (w *Writer) printf(format string, a ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, a...)
+	}
+}
+
+// Describe writes help and type of a metric
+func (w *Writer) Describe(name, typ, help string) {
+	w.printf("# HELP %s %s\n", name, help)
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes a sample of a metric. Labels are pairs of label name and
+// label value, e.g. "account", "alice".
+func (w *Writer) Sample(name string, value uint64, labels ...string) {
+	if len(labels) == 0 {
+		w.printf("%s %d\n", name, value)
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escape(labels[i+1])))
+	}
+	w.printf("%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+}
+
+// escape escapes a label value
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// WriteSnmp writes kcp counters
+func WriteSnmp(w *Writer, snmp *kcp.Snmp) {
+	s := snmp.Copy()
+	for _, m := range []struct {
+		name  string
+		typ   string
+		help  string
+		value uint64
+	}{
+		{"tinyvpn_kcp_bytes_sent_total", Counter, "Bytes sent by kcp sessions.", s.BytesSent},
+		{"tinyvpn_kcp_bytes_received_total", Counter, "Bytes received by kcp sessions.", s.BytesReceived},
+		{"tinyvpn_kcp_max_connections", Gauge, "Max count of kcp connections.", s.MaxConn},
+		{"tinyvpn_kcp_active_opens_total", Counter, "Kcp connections opened actively.", s.ActiveOpens},
+		{"tinyvpn_kcp_passive_opens_total", Counter, "Kcp connections opened passively.", s.PassiveOpens},
+		{"tinyvpn_kcp_connections", Gauge, "Count of established kcp connections.", s.CurrEstab},
+		{"tinyvpn_kcp_in_errors_total", Counter, "Udp read errors.", s.InErrs},
+		{"tinyvpn_kcp_in_checksum_errors_total", Counter, "Packets with wrong checksum.", s.InCsumErrors},
+		{"tinyvpn_kcp_input_errors_total", Counter, "Packets rejected by kcp.", s.KCPInErrors},
+		{"tinyvpn_kcp_in_segments_total", Counter, "Kcp segments received.", s.InSegs},
+		{"tinyvpn_kcp_out_segments_total", Counter, "Kcp segments sent.", s.OutSegs},
+		{"tinyvpn_kcp_in_bytes_total", Counter, "Udp bytes received.", s.InBytes},
+		{"tinyvpn_kcp_out_bytes_total", Counter, "Udp bytes sent.", s.OutBytes},
+		{"tinyvpn_kcp_retransmitted_segments_total", Counter, "Kcp segments retransmitted.", s.RetransSegs},
+		{"tinyvpn_kcp_fast_retransmitted_segments_total", Counter, "Kcp segments fast retransmitted.", s.FastRetransSegs},
+		{"tinyvpn_kcp_early_retransmitted_segments_total", Counter, "Kcp segments early retransmitted.", s.EarlyRetransSegs},
+		{"tinyvpn_kcp_lost_segments_total", Counter, "Kcp segments inferred as lost.", s.LostSegs},
+		{"tinyvpn_kcp_repeated_segments_total", Counter, "Duplicated kcp segments received.", s.RepeatSegs},
+		{"tinyvpn_kcp_fec_segments_total", Counter, "Fec segments received.", s.FECSegs},
+		{"tinyvpn_kcp_fec_errors_total", Counter, "Incorrect packets recovered by fec.", s.FECErrs},
+		{"tinyvpn_kcp_fec_recovered_total", Counter, "Packets recovered by fec.", s.FECRecovered},
+		{"tinyvpn_kcp_fec_short_shards_total", Counter, "Fec groups without enough shards for recovery.", s.FECShortShards},
+	} {
+		w.Describe(m.name, m.typ, m.help)
+		w.Sample(m.name, m.value)
+	}
+}
+
+// Serve serves metrics on /metrics of addr. collect is called to write
+// metrics on every request.
+func Serve(addr string, collect func(w *Writer)) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w := NewWriter(rw)
+		collect(w)
+		if w.Err() != nil {
+			log.Println("metrics", "write error", w.Err())
+		}
+	})
+	go func() {
+		log.Println("metrics listening on", addr)
+		log.Println("metrics stopped", http.Serve(listener, mux))
+	}()
+	return nil
+}
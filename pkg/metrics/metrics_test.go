@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/xtaci/kcp-go"
+)
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Describe("tinyvpn_test_total", Counter, "Test counter.")
+	w.Sample("tinyvpn_test_total", 3, "account", `a"b\c`, "address", "10.0.0.2")
+	w.Sample("tinyvpn_test_total", 4)
+	expected := `# HELP tinyvpn_test_total Test counter.
+# TYPE tinyvpn_test_total counter
+tinyvpn_test_total{account="a\"b\\c",address="10.0.0.2"} 3
+tinyvpn_test_total 4
+`
+	if w.Err() != nil || buf.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s", buf.String())
+	}
+}
+
+func TestWriteSnmp(t *testing.T) {
+	buf := &bytes.Buffer{}
+	snmp := &kcp.Snmp{RetransSegs: 7}
+	WriteSnmp(NewWriter(buf), snmp)
+	if !strings.Contains(buf.String(), "\ntinyvpn_kcp_retransmitted_segments_total 7\n") {
+		t.Fatalf("retransmitted segments not found:\n%s", buf.String())
+	}
+}
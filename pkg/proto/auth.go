@@ -3,11 +3,24 @@ package proto
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"net"
 )
 
-// Authentication stores Authentication info of client
+// AuthVersion is the version of authentication wire format
+const AuthVersion = 3
+
+// Authentication stores Authentication info of client.
+// It is sealed by AES-GCM with SecretKey and shows as below:
+//     ----------------------------------------------------
+//     Version(1) NameLength(1) Name Nonce(12)
+//     Sealed(Timestamp(4) Key(16) PublicKey(32) Address(4)) Tag(16)
+//     ----------------------------------------------------
+// Version, NameLength and Name are authenticated but not encrypted.
+// Address is 0.0.0.0 if client has no preferred address.
 type Authentication struct {
 	// Account is the user name
 	Account string
@@ -15,65 +28,200 @@ type Authentication struct {
 	Timestamp uint32
 	// Key is the aes key of client
 	Key []byte
+	// PublicKey is the ephemeral X25519 public key of client
+	PublicKey []byte
+	// Address is the preferred tunnel ip of client, e.g. the address
+	// assigned before reconnecting. It's optional.
+	Address net.IP
 	// SecretKey is used for encrypting auth data
 	SecretKey []byte
 }
 
 // Length returns the length of mardhalled data
 func (a *Authentication) Length() int {
-	nameLength := len(a.Account) + 1
-	dataLength := nameLength + 20
-	dataLength = dataLength/16*16 + 16
-	return nameLength + dataLength
+	return 2 + len(a.Account) + 12 + 56 + 16
 }
 
 // Marshal object to data
 func (a *Authentication) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, a.Length()))
+	if len(a.Account) > 255 {
+		return nil, fmt.Errorf("account is too long: %d", len(a.Account))
+	}
+	if len(a.Key) != 16 {
+		return nil, fmt.Errorf("invalid key: %x", a.Key)
+	}
+	if len(a.PublicKey) != 32 {
+		return nil, fmt.Errorf("invalid public key: %x", a.PublicKey)
+	}
+	address := net.IPv4zero.To4()
+	if a.Address != nil {
+		if address = a.Address.To4(); address == nil {
+			return nil, fmt.Errorf("invalid address: %s", a.Address)
+		}
+	}
+	aead, err := newAEAD(a.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, a.Length()))
+	buf.WriteByte(AuthVersion)
 	buf.WriteByte(byte(len(a.Account)))
 	buf.WriteString(a.Account)
-	tBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(tBytes, a.Timestamp)
-	buf.Write(tBytes)
-	buf.Write(a.Key)
-	cipher, err := aes.NewCipher(a.SecretKey)
-	if err != nil {
+	header := buf.Len()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
 		return nil, err
 	}
+	buf.Write(nonce)
+	plaintext := make([]byte, 56)
+	binary.BigEndian.PutUint32(plaintext, a.Timestamp)
+	copy(plaintext[4:], a.Key)
+	copy(plaintext[20:], a.PublicKey)
+	copy(plaintext[52:], address)
 	result := buf.Bytes()
-	pos := 1 + len(a.Account)
-	cipher.Encrypt(result[pos:], result[pos:])
-	return result, nil
+	return aead.Seal(result, nonce, plaintext, result[:header]), nil
 }
 
-// Unmarshal marshal data to object
+// Unmarshal marshal data to object. It only parses account if SecretKey is nil.
 func (a *Authentication) Unmarshal(data []byte) error {
-	if len(data) <= 1 {
-		return fmt.Errorf("wrong account length: %d", len(data))
+	if len(data) < 2 {
+		return fmt.Errorf("wrong authentication data length: %d", len(data))
+	}
+	if data[0] != AuthVersion {
+		return fmt.Errorf("unsupported authentication version: %d", data[0])
+	}
+	header := 2 + int(data[1])
+	if len(data) < header {
+		return fmt.Errorf("wrong account length: %d", data[1])
 	}
-	nameLength := data[0]
-	a.Account = string(data[1 : nameLength+1])
+	a.Account = string(data[2:header])
 	if a.SecretKey == nil {
 		return nil
 	}
-	encryptedData := data[1+nameLength:]
-	if len(encryptedData) < 32 {
+	aead, err := newAEAD(a.SecretKey)
+	if err != nil {
+		return err
+	}
+	if len(data) != header+aead.NonceSize()+56+aead.Overhead() {
 		return fmt.Errorf("wrong authentication data length: %d", len(data))
 	}
-	cipher, err := aes.NewCipher(a.SecretKey)
+	nonce := data[header : header+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[header+aead.NonceSize():], data[:header])
+	if err != nil {
+		return fmt.Errorf("can't open authentication of account %s: %s", a.Account, err)
+	}
+	a.Timestamp = binary.BigEndian.Uint32(plaintext)
+	a.Key = plaintext[4:20]
+	a.PublicKey = plaintext[20:52]
+	a.Address = nil
+	if address := net.IP(plaintext[52:]); !address.Equal(net.IPv4zero) {
+		a.Address = address
+	}
+	return nil
+}
+
+// newAEAD creates an AES-GCM cipher via key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AuthResult is the reply of server for an Authentication.
+// It shows as below:
+//     ----------------------------------------------------
+//     Accepted(1) ReasonLength(1) Reason
+//     Nonce(12) Sealed(PublicKey(32) Address(4) Gateway(4)) Tag(16)
+//     ----------------------------------------------------
+// Only accepted result has the sealed part. It is sealed by AES-GCM with
+// SecretKey, and the Key of authentication is authenticated with it.
+type AuthResult struct {
+	// Accepted shows whether the authentication is accepted
+	Accepted bool
+	// Reason describes why the authentication is rejected
+	Reason string
+	// PublicKey is the ephemeral X25519 public key of server
+	PublicKey []byte
+	// Address is the tunnel ip assigned to client
+	Address net.IP
+	// Gateway is the tunnel ip of server
+	Gateway net.IP
+	// Key is the aes key of client in authentication
+	Key []byte
+	// SecretKey is used for encrypting result data
+	SecretKey []byte
+}
+
+// Marshal object to data
+func (r *AuthResult) Marshal() ([]byte, error) {
+	if len(r.Reason) > 255 {
+		return nil, fmt.Errorf("reason is too long: %d", len(r.Reason))
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(r.Reason)+2+12+40+16))
+	if r.Accepted {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(byte(len(r.Reason)))
+	buf.WriteString(r.Reason)
+	if !r.Accepted {
+		return buf.Bytes(), nil
+	}
+	if len(r.PublicKey) != 32 {
+		return nil, fmt.Errorf("invalid public key: %x", r.PublicKey)
+	}
+	if r.Address.To4() == nil || r.Gateway.To4() == nil {
+		return nil, fmt.Errorf("invalid address %s or gateway %s", r.Address, r.Gateway)
+	}
+	aead, err := newAEAD(r.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	header := buf.Len()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	buf.Write(nonce)
+	result := buf.Bytes()
+	plaintext := make([]byte, 0, 40)
+	plaintext = append(plaintext, r.PublicKey...)
+	plaintext = append(plaintext, r.Address.To4()...)
+	plaintext = append(plaintext, r.Gateway.To4()...)
+	ad := append(append([]byte(nil), result[:header]...), r.Key...)
+	return aead.Seal(result, nonce, plaintext, ad), nil
+}
+
+// Unmarshal marshal data to object. SecretKey and Key are required for
+// opening accepted result.
+func (r *AuthResult) Unmarshal(data []byte) error {
+	if len(data) < 2 || len(data) < int(data[1])+2 {
+		return fmt.Errorf("wrong auth result length: %d", len(data))
+	}
+	header := int(data[1]) + 2
+	r.Accepted = data[0] == 1
+	r.Reason = string(data[2:header])
+	if !r.Accepted {
+		return nil
+	}
+	aead, err := newAEAD(r.SecretKey)
 	if err != nil {
 		return err
 	}
-	cipher.Decrypt(encryptedData, encryptedData)
-	nameLength = encryptedData[0]
-	name := string(encryptedData[1 : nameLength+1])
-	if name != a.Account {
-		return fmt.Errorf("unmatched accout: %s, %s", a.Account, name)
+	if len(data) != header+aead.NonceSize()+40+aead.Overhead() {
+		return fmt.Errorf("wrong auth result length: %d", len(data))
 	}
-	a.Timestamp = binary.BigEndian.Uint32(encryptedData[nameLength+1 : nameLength+5])
-	a.Key = encryptedData[nameLength+5:]
-	if len(a.Key) != 16 {
-		return fmt.Errorf("invalid key: %x", a.Key)
+	nonce := data[header : header+aead.NonceSize()]
+	ad := append(append([]byte(nil), data[:header]...), r.Key...)
+	plaintext, err := aead.Open(nil, nonce, data[header+aead.NonceSize():], ad)
+	if err != nil {
+		return fmt.Errorf("can't open auth result: %s", err)
 	}
+	r.PublicKey = plaintext[:32]
+	r.Address = net.IP(plaintext[32:36])
+	r.Gateway = net.IP(plaintext[36:40])
 	return nil
 }
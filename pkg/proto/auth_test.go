@@ -0,0 +1,111 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAuthentication(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, 32)
+	auth := &Authentication{
+		Account:   "alice",
+		Timestamp: 1487779200,
+		Key:       []byte("0123456789abcdef"),
+		PublicKey: bytes.Repeat([]byte{9}, 32),
+		Address:   net.ParseIP("10.0.0.2"),
+		SecretKey: secret,
+	}
+	data, err := auth.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != auth.Length() {
+		t.Fatalf("length should be %d, but got %d", auth.Length(), len(data))
+	}
+	if bytes.Contains(data, auth.Key) {
+		t.Fatal("key should be encrypted")
+	}
+
+	result := &Authentication{}
+	if err := result.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if result.Account != auth.Account {
+		t.Fatalf("account should be %s, but got %s", auth.Account, result.Account)
+	}
+	result.SecretKey = secret
+	if err := result.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if result.Timestamp != auth.Timestamp || !bytes.Equal(result.Key, auth.Key) ||
+		!bytes.Equal(result.PublicKey, auth.PublicKey) || !result.Address.Equal(auth.Address) {
+		t.Fatalf("unmatched authentication: %+v", result)
+	}
+
+	// wrong secret key
+	result.SecretKey = bytes.Repeat([]byte{8}, 32)
+	if err := result.Unmarshal(data); err == nil {
+		t.Fatal("authentication with wrong secret key should fail")
+	}
+	// tampered data
+	for _, pos := range []int{2, len(data) - 1, 10} {
+		tampered := append([]byte(nil), data...)
+		tampered[pos] ^= 1
+		result := &Authentication{SecretKey: secret}
+		if err := result.Unmarshal(tampered); err == nil {
+			t.Fatalf("tampered authentication at %d should fail", pos)
+		}
+	}
+	// no preferred address
+	auth.Address = nil
+	if data, err = auth.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	result = &Authentication{SecretKey: secret}
+	if err := result.Unmarshal(data); err != nil || result.Address != nil {
+		t.Fatalf("address should be nil, but got %v %v", result.Address, err)
+	}
+}
+
+func TestAuthResult(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, 32)
+	key := []byte("0123456789abcdef")
+	result := &AuthResult{
+		Accepted:  true,
+		PublicKey: bytes.Repeat([]byte{9}, 32),
+		Address:   net.ParseIP("10.0.0.2"),
+		Gateway:   net.ParseIP("10.0.0.1"),
+		Key:       key,
+		SecretKey: secret,
+	}
+	data, err := result.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := &AuthResult{Key: key, SecretKey: secret}
+	if err := opened.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if !opened.Accepted || !bytes.Equal(opened.PublicKey, result.PublicKey) ||
+		!opened.Address.Equal(result.Address) || !opened.Gateway.Equal(result.Gateway) {
+		t.Fatalf("unmatched auth result: %+v", opened)
+	}
+	// result of another authentication
+	opened = &AuthResult{Key: []byte("fedcba9876543210"), SecretKey: secret}
+	if err := opened.Unmarshal(data); err == nil {
+		t.Fatal("auth result with wrong key should fail")
+	}
+
+	data, err = (&AuthResult{Reason: "unknown account: bob"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened = &AuthResult{}
+	if err := opened.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if opened.Accepted || opened.Reason != "unknown account: bob" {
+		t.Fatalf("unmatched auth result: %+v", opened)
+	}
+}
@@ -0,0 +1,115 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PushConfig is the config which server pushes to client after authentication.
+// It shows as below:
+//     ----------------------------------------------------
+//     MTU(2) RouteCount(1) [IP(4) PrefixLength(1)]...
+//     DNSCount(1) [IP(4)]... DomainCount(1) [Length(1) Domain]...
+//     ----------------------------------------------------
+type PushConfig struct {
+	// MTU is the mtu of tunnel device. 0 means using system default.
+	MTU uint16
+	// Routes contains subnets which should be routed via tunnel
+	Routes []*net.IPNet
+	// DNS contains dns servers
+	DNS []net.IP
+	// SearchDomains contains dns search domains
+	SearchDomains []string
+}
+
+// Marshal object to data
+func (c *PushConfig) Marshal() ([]byte, error) {
+	if len(c.Routes) > 255 || len(c.DNS) > 255 || len(c.SearchDomains) > 255 {
+		return nil, fmt.Errorf("too many routes, dns servers or search domains")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 256))
+	binary.Write(buf, binary.BigEndian, c.MTU)
+	buf.WriteByte(byte(len(c.Routes)))
+	for _, r := range c.Routes {
+		ip := r.IP.To4()
+		ones, bits := r.Mask.Size()
+		if ip == nil || bits != 32 {
+			return nil, fmt.Errorf("invalid route: %s", r.String())
+		}
+		buf.Write(ip)
+		buf.WriteByte(byte(ones))
+	}
+	buf.WriteByte(byte(len(c.DNS)))
+	for _, dns := range c.DNS {
+		ip := dns.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns server: %s", dns.String())
+		}
+		buf.Write(ip)
+	}
+	buf.WriteByte(byte(len(c.SearchDomains)))
+	for _, domain := range c.SearchDomains {
+		if len(domain) > 255 {
+			return nil, fmt.Errorf("search domain is too long: %s", domain)
+		}
+		buf.WriteByte(byte(len(domain)))
+		buf.WriteString(domain)
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal marshal data to object
+func (c *PushConfig) Unmarshal(data []byte) error {
+	r := bytes.NewReader(data)
+	var count byte
+	if err := binary.Read(r, binary.BigEndian, &c.MTU); err != nil {
+		return fmt.Errorf("wrong config length: %d", len(data))
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("wrong config length: %d", len(data))
+	}
+	c.Routes = make([]*net.IPNet, 0, count)
+	for i := byte(0); i < count; i++ {
+		route := make([]byte, 5)
+		if _, err := io.ReadFull(r, route); err != nil || route[4] > 32 {
+			return fmt.Errorf("invalid route in config")
+		}
+		c.Routes = append(c.Routes, &net.IPNet{
+			IP:   net.IP(route[:4]),
+			Mask: net.CIDRMask(int(route[4]), 32),
+		})
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("wrong config length: %d", len(data))
+	}
+	c.DNS = make([]net.IP, 0, count)
+	for i := byte(0); i < count; i++ {
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return fmt.Errorf("invalid dns server in config")
+		}
+		c.DNS = append(c.DNS, net.IP(ip))
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("wrong config length: %d", len(data))
+	}
+	c.SearchDomains = make([]string, 0, count)
+	for i := byte(0); i < count; i++ {
+		length, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("invalid search domain in config")
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return fmt.Errorf("invalid search domain in config")
+		}
+		c.SearchDomains = append(c.SearchDomains, string(domain))
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("wrong config length: %d", len(data))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package proto
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPushConfig(t *testing.T) {
+	_, r1, _ := net.ParseCIDR("10.0.0.0/24")
+	_, r2, _ := net.ParseCIDR("192.168.1.0/24")
+	config := &PushConfig{
+		MTU:           1400,
+		Routes:        []*net.IPNet{r1, r2},
+		DNS:           []net.IP{net.ParseIP("10.0.0.1").To4()},
+		SearchDomains: []string{"corp.example.com", "example.com"},
+	}
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &PushConfig{}
+	if err := result.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, result) {
+		t.Fatalf("unmatched config: %+v", result)
+	}
+	if err := result.Unmarshal(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated config should fail")
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"log"
 )
 
-// Pipe pipes r to w
+// Pipe pipes r to w. The returned channel is closed after the pipe stopped.
 func Pipe(name string, running *bool, r io.Reader, w io.Writer) <-chan struct{} {
 	signal := make(chan struct{})
 	go func() {
@@ -27,7 +27,7 @@ func Pipe(name string, running *bool, r io.Reader, w io.Writer) <-chan struct{}
 			}
 		}
 		log.Println(name, "pip stop")
-		signal <- struct{}{}
+		close(signal)
 	}()
 	return signal
 }
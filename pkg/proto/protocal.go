@@ -1,6 +1,32 @@
 package proto
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Version is the current version of x protocal
+const Version byte = 1
+
+const (
+	// TypeData is the type of data frame which contains an ip packet.
+	// Other types are control messages.
+	TypeData byte = 0
+	// TypeAuthentication is the type of Authentication
+	TypeAuthentication byte = 1
+	// TypeAuthResult is the type of AuthResult
+	TypeAuthResult byte = 2
+	// TypeConfig is the type of PushConfig
+	TypeConfig byte = 3
+	// TypeDisconnect is the type of Disconnect
+	TypeDisconnect byte = 4
+	// TypeKeepalive is the type of Keepalive
+	TypeKeepalive byte = 5
+)
+
+// headerLength is the length of x protocal header
+const headerLength = 5
 
 // XProtocal describes a protocal of x.
 // It should have at least 5 bytes and show as below:
@@ -9,6 +35,7 @@ import "fmt"
 //     Version Type    ID      LengthH
 //     LengthL Data.....................
 //     ---------------------------------
+// Length is the length of Data, so a protocal can be framed in a stream.
 type XProtocal struct {
 	Version byte
 	Type    byte
@@ -19,16 +46,63 @@ type XProtocal struct {
 
 // NewXProtocal translates a packet to protocal
 func NewXProtocal(data []byte) (*XProtocal, error) {
-	if len(data) < 5 {
+	if len(data) < headerLength {
 		return nil, fmt.Errorf("a x protocal should have at least 5 bytes")
 	}
-	return &XProtocal{
+	p := &XProtocal{
 		Version: data[0],
 		Type:    data[1],
 		ID:      data[2],
-		Length:  uint16(data[3]) << 8 & uint16(data[4]),
-		Data:    data[5:],
-	}, nil
+		Length:  uint16(data[3])<<8 | uint16(data[4]),
+	}
+	if p.Version != Version {
+		return nil, fmt.Errorf("unsupported x protocal version: %d", p.Version)
+	}
+	if len(data) != headerLength+int(p.Length) {
+		return nil, fmt.Errorf("x protocal length %d mismatches data length %d", p.Length, len(data)-headerLength)
+	}
+	p.Data = data[headerLength:]
+	return p, nil
+}
+
+// Marshal translates protocal to a packet
+func (p *XProtocal) Marshal() ([]byte, error) {
+	if len(p.Data) > 0xffff {
+		return nil, fmt.Errorf("data is too long: %d", len(p.Data))
+	}
+	data := make([]byte, headerLength, headerLength+len(p.Data))
+	data[0] = p.Version
+	data[1] = p.Type
+	data[2] = p.ID
+	data[3] = byte(len(p.Data) >> 8)
+	data[4] = byte(len(p.Data))
+	return append(data, p.Data...), nil
+}
+
+// ReadFrame reads a protocal from a stream
+func ReadFrame(r io.Reader) (*XProtocal, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[3])<<8 | int(header[4])
+	data := make([]byte, headerLength+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[headerLength:]); err != nil {
+		return nil, err
+	}
+	return NewXProtocal(data)
+}
+
+// WriteFrame writes a protocal to a stream. The protocal is written by
+// calling Write once.
+func WriteFrame(w io.Writer, p *XProtocal) error {
+	data, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 // DataSaver describes an interface of protocal data saver.
@@ -38,3 +112,81 @@ type DataSaver interface {
 	// Unmarshal data to object
 	Unmarshal(data []byte) error
 }
+
+// registry maps protocal types to data saver factories
+var registry = struct {
+	sync.RWMutex
+	factories map[byte]func() DataSaver
+}{factories: make(map[byte]func() DataSaver)}
+
+func init() {
+	Register(TypeAuthentication, func() DataSaver { return &Authentication{} })
+	Register(TypeAuthResult, func() DataSaver { return &AuthResult{} })
+	Register(TypeConfig, func() DataSaver { return &PushConfig{} })
+	Register(TypeDisconnect, func() DataSaver { return &Disconnect{} })
+	Register(TypeKeepalive, func() DataSaver { return &Keepalive{} })
+}
+
+// Register registers a data saver factory for a protocal type.
+// It panics if the type has been registered.
+func Register(typ byte, factory func() DataSaver) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.factories[typ]; ok {
+		panic(fmt.Sprintf("protocal type %d has been registered", typ))
+	}
+	registry.factories[typ] = factory
+}
+
+// Decode unmarshals the data of protocal to a data saver of its type
+func Decode(p *XProtocal) (DataSaver, error) {
+	registry.RLock()
+	factory, ok := registry.factories[p.Type]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown protocal type: %d", p.Type)
+	}
+	saver := factory()
+	if err := saver.Unmarshal(p.Data); err != nil {
+		return nil, err
+	}
+	return saver, nil
+}
+
+// Encode marshals a data saver to a protocal of typ
+func Encode(typ byte, saver DataSaver) (*XProtocal, error) {
+	data, err := saver.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0xffff {
+		return nil, fmt.Errorf("data is too long: %d", len(data))
+	}
+	return &XProtocal{
+		Version: Version,
+		Type:    typ,
+		Length:  uint16(len(data)),
+		Data:    data,
+	}, nil
+}
+
+// WriteMessage encodes a data saver and writes it as a frame
+func WriteMessage(w io.Writer, typ byte, saver DataSaver) error {
+	p, err := Encode(typ, saver)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, p)
+}
+
+// ReadMessage reads a frame of typ and unmarshals it to a data saver
+func ReadMessage(r io.Reader, typ byte, saver DataSaver) error {
+	p, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+	if p.Type != typ {
+		return fmt.Errorf("unexpected protocal type: %d, expect %d", p.Type, typ)
+	}
+	return saver.Unmarshal(p.Data)
+}
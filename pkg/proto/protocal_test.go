@@ -0,0 +1,65 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestXProtocal(t *testing.T) {
+	p := &XProtocal{
+		Version: Version,
+		Type:    TypeConfig,
+		ID:      7,
+		Data:    bytes.Repeat([]byte{1}, 300),
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewXProtocal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Type != p.Type || result.ID != p.ID || result.Length != 300 || !bytes.Equal(result.Data, p.Data) {
+		t.Fatalf("unmatched protocal: %+v", result)
+	}
+	if _, err := NewXProtocal(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated protocal should fail")
+	}
+	data[0] = Version + 1
+	if _, err := NewXProtocal(data); err == nil {
+		t.Fatal("protocal with unknown version should fail")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	_, r, _ := net.ParseCIDR("10.0.0.0/24")
+	config := &PushConfig{MTU: 1400, Routes: []*net.IPNet{r}}
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 3; i++ {
+		if err := WriteMessage(buf, TypeConfig, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		p, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saver, err := Decode(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, ok := saver.(*PushConfig)
+		if !ok || result.MTU != 1400 || result.Routes[0].String() != r.String() {
+			t.Fatalf("unmatched config: %+v", saver)
+		}
+	}
+	if err := ReadMessage(buf, TypeAuthResult, &AuthResult{}); err == nil {
+		t.Fatal("message with unexpected type should fail")
+	}
+	if _, err := Decode(&XProtocal{Version: Version, Type: 255}); err == nil {
+		t.Fatal("unknown type should fail")
+	}
+}
@@ -0,0 +1,132 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// GenerateKey generates an ephemeral X25519 key pair for key exchange
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// SessionKeys derives traffic keys of a session from the ephemeral key of current
+// peer and the ephemeral public key of remote peer. Key is the aes key of client
+// in authentication. It returns the key for client-to-server traffic and the key
+// for server-to-client traffic.
+func SessionKeys(private *ecdh.PrivateKey, peer []byte, key []byte) ([]byte, []byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientKey, err := hkdf.Key(sha256.New, shared, key, "tinyvpn client to server", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverKey, err := hkdf.Key(sha256.New, shared, key, "tinyvpn server to client", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientKey, serverKey, nil
+}
+
+// maxRecordLength is the max length of a sealed record
+const maxRecordLength = 65535
+
+// SecureConn seals every write as a record with traffic keys. A record shows as below:
+//     ---------------------------------
+//     Length(2) Sealed(Data) Tag(16)
+//     ---------------------------------
+// Nonces are the counters of records, so records can't be replayed or reordered.
+type SecureConn struct {
+	net.Conn
+	reader *bufio.Reader
+	rLock  sync.Mutex
+	rAEAD  cipher.AEAD
+	rNonce uint64
+	rBuf   []byte
+	wLock  sync.Mutex
+	wAEAD  cipher.AEAD
+	wNonce uint64
+}
+
+// NewSecureConn creates a SecureConn. It writes with sendKey and reads with recvKey.
+func NewSecureConn(conn net.Conn, sendKey, recvKey []byte) (*SecureConn, error) {
+	wAEAD, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	rAEAD, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, maxRecordLength+2),
+		rAEAD:  rAEAD,
+		wAEAD:  wAEAD,
+	}, nil
+}
+
+// nonce generates nonce via counter
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], counter)
+	return n
+}
+
+// Read reads and opens records. Data is kept for next reading if p is too small.
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	if len(c.rBuf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(c.reader, record); err != nil {
+			return 0, err
+		}
+		data, err := c.rAEAD.Open(record[:0], nonce(c.rAEAD, c.rNonce), record, header)
+		if err != nil {
+			return 0, fmt.Errorf("can't open record: %s", err)
+		}
+		c.rNonce++
+		c.rBuf = data
+	}
+	n := copy(p, c.rBuf)
+	c.rBuf = c.rBuf[n:]
+	return n, nil
+}
+
+// Write seals p as a record and writes it
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	length := len(p) + c.wAEAD.Overhead()
+	if length > maxRecordLength {
+		return 0, fmt.Errorf("data is too long: %d", len(p))
+	}
+	record := make([]byte, 2, length+2)
+	binary.BigEndian.PutUint16(record, uint16(length))
+	record = c.wAEAD.Seal(record, nonce(c.wAEAD, c.wNonce), p, record[:2])
+	c.wNonce++
+	if _, err := c.Conn.Write(record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
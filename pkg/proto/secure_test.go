@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSecureConn(t *testing.T) {
+	client, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("0123456789abcdef")
+	c2s, s2c, err := SessionKeys(client, server.PublicKey().Bytes(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2s2, s2c2, err := SessionKeys(server, client.PublicKey().Bytes(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c2s, c2s2) || !bytes.Equal(s2c, s2c2) || bytes.Equal(c2s, s2c) {
+		t.Fatal("unmatched session keys")
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	clientConn, err := NewSecureConn(c1, c2s, s2c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := NewSecureConn(c2, s2c, c2s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte{1}, 3000), []byte("world")}
+	go func() {
+		for _, m := range messages {
+			if _, err := clientConn.Write(m); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 4096)
+	for _, m := range messages {
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], m) {
+			t.Fatalf("unmatched message: %x", buf[:n])
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Disconnect notifies peer that the tunnel is closing
+type Disconnect struct {
+	// Reason describes why the tunnel is closing
+	Reason string
+}
+
+// Marshal object to data
+func (d *Disconnect) Marshal() ([]byte, error) {
+	return []byte(d.Reason), nil
+}
+
+// Unmarshal marshal data to object
+func (d *Disconnect) Unmarshal(data []byte) error {
+	d.Reason = string(data)
+	return nil
+}
+
+// Keepalive is sent periodically to detect dead peers. Peer replies a
+// keepalive with the same time, so the sender can measure round trip time.
+type Keepalive struct {
+	// Reply shows whether the keepalive is a reply
+	Reply bool
+	// Time is the unix nano time of sender
+	Time int64
+}
+
+// Marshal object to data
+func (k *Keepalive) Marshal() ([]byte, error) {
+	data := make([]byte, 9)
+	if k.Reply {
+		data[0] = 1
+	}
+	binary.BigEndian.PutUint64(data[1:], uint64(k.Time))
+	return data, nil
+}
+
+// Unmarshal marshal data to object
+func (k *Keepalive) Unmarshal(data []byte) error {
+	if len(data) != 9 {
+		return fmt.Errorf("wrong keepalive length: %d", len(data))
+	}
+	k.Reply = data[0] == 1
+	k.Time = int64(binary.BigEndian.Uint64(data[1:]))
+	return nil
+}
+
+// disconnectLinger is the duration for flushing the disconnect message
+// before closing the conn
+const disconnectLinger = 200 * time.Millisecond
+
+// disconnectTimeout is the max duration for sending the disconnect message.
+// Writing blocks if peer is dead and its window is full.
+const disconnectTimeout = time.Second
+
+// Handler handles a control message. The tunnel stops reading if it
+// returns an error.
+type Handler func(message DataSaver) error
+
+// Tunnel carries data frames and control frames on a conn. Data frames
+// contain ip packets and control frames contain x protocal messages.
+// Tunnel reads and writes ip packets like a tunnel device, and dispatches
+// control frames to handlers when reading.
+type Tunnel struct {
+	// lastData and rtt are accessed atomically, so they must be 64-bit
+	// aligned on 32-bit platforms by being at the top
+	lastData int64
+	rtt      int64
+	net.Conn
+	// Name is used for logging
+	Name string
+	// Timeout is the max duration without any frame from peer. Peer is
+	// considered dead after timeout. 0 means no timeout.
+	Timeout time.Duration
+	// IdleTimeout is the max duration without any data frame. Tunnel is
+	// disconnected after idle timeout. 0 means no idle timeout.
+	IdleTimeout time.Duration
+	lock        sync.RWMutex
+	handlers    map[byte]Handler
+	once        sync.Once
+	die         chan struct{}
+}
+
+// NewTunnel creates a tunnel on conn. A disconnect message stops the
+// tunnel and keepalives are replied by default.
+func NewTunnel(name string, conn net.Conn) *Tunnel {
+	t := &Tunnel{
+		Conn:     conn,
+		Name:     name,
+		handlers: make(map[byte]Handler),
+		lastData: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	t.Handle(TypeDisconnect, func(message DataSaver) error {
+		return fmt.Errorf("peer disconnected: %s", message.(*Disconnect).Reason)
+	})
+	t.Handle(TypeKeepalive, t.keepalive)
+	return t
+}
+
+// Handle sets the handler of a control message type
+func (t *Tunnel) Handle(typ byte, handler Handler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.handlers[typ] = handler
+}
+
+// Read reads an ip packet. Control frames before the packet are dispatched
+// to handlers, and unknown control frames are ignored.
+func (t *Tunnel) Read(p []byte) (int, error) {
+	for {
+		if t.Timeout > 0 {
+			t.SetReadDeadline(time.Now().Add(t.Timeout))
+		}
+		frame, err := ReadFrame(t.Conn)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return 0, fmt.Errorf("peer is dead: no frame in %s", t.Timeout)
+			}
+			return 0, err
+		}
+		if frame.Type == TypeData {
+			if len(p) < len(frame.Data) {
+				return 0, io.ErrShortBuffer
+			}
+			atomic.StoreInt64(&t.lastData, time.Now().UnixNano())
+			return copy(p, frame.Data), nil
+		}
+		t.lock.RLock()
+		handler, ok := t.handlers[frame.Type]
+		t.lock.RUnlock()
+		if !ok {
+			log.Println(t.Name, "ignore control message", frame.Type)
+			continue
+		}
+		message, err := Decode(frame)
+		if err != nil {
+			return 0, err
+		}
+		if err = handler(message); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes an ip packet as a data frame
+func (t *Tunnel) Write(p []byte) (int, error) {
+	err := WriteFrame(t.Conn, &XProtocal{
+		Version: Version,
+		Type:    TypeData,
+		Length:  uint16(len(p)),
+		Data:    p,
+	})
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&t.lastData, time.Now().UnixNano())
+	return len(p), nil
+}
+
+// Send writes a control message
+func (t *Tunnel) Send(typ byte, message DataSaver) error {
+	return WriteMessage(t.Conn, typ, message)
+}
+
+// Close closes the tunnel
+func (t *Tunnel) Close() error {
+	t.once.Do(func() {
+		close(t.die)
+	})
+	return t.Conn.Close()
+}
+
+// Disconnect notifies peer with reason and closes the tunnel. It waits a
+// moment before closing, because the message may be discarded if the conn
+// is closed before it's flushed. The notification is given up after
+// disconnectTimeout, so it never blocks on a dead peer.
+func (t *Tunnel) Disconnect(reason string) error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- t.Send(TypeDisconnect, &Disconnect{reason})
+	}()
+	var err error
+	select {
+	case err = <-sent:
+		if err == nil {
+			time.Sleep(disconnectLinger)
+		}
+	case <-time.After(disconnectTimeout):
+		err = fmt.Errorf("can't send disconnect message in %s", disconnectTimeout)
+	}
+	// closing the conn also stops the blocked sending
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RTT returns the round trip time measured by the last keepalive
+func (t *Tunnel) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.rtt))
+}
+
+// Idle returns the duration since the last data frame
+func (t *Tunnel) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.lastData)))
+}
+
+// keepalive replies keepalives and measures round trip time
+func (t *Tunnel) keepalive(message DataSaver) error {
+	k := message.(*Keepalive)
+	if k.Reply {
+		atomic.StoreInt64(&t.rtt, time.Now().UnixNano()-k.Time)
+		return nil
+	}
+	return t.Send(TypeKeepalive, &Keepalive{Reply: true, Time: k.Time})
+}
+
+// StartKeepalive sends keepalives periodically and disconnects the tunnel
+// after idle timeout. It stops after the tunnel closed. Idle timeout is
+// checked with keepalives, so it doesn't work without keepalives.
+func (t *Tunnel) StartKeepalive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.die:
+				return
+			case <-ticker.C:
+			}
+			if t.IdleTimeout > 0 && t.Idle() > t.IdleTimeout {
+				log.Println(t.Name, "idle timeout", t.IdleTimeout)
+				t.Disconnect(fmt.Sprintf("idle timeout %s", t.IdleTimeout))
+				return
+			}
+			if err := t.Send(TypeKeepalive, &Keepalive{Time: time.Now().UnixNano()}); err != nil {
+				log.Println(t.Name, "keepalive error", err)
+				t.Close()
+				return
+			}
+		}
+	}()
+}
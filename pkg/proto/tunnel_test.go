@@ -0,0 +1,86 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewTunnel("client", c1)
+	server := NewTunnel("server", c2)
+	defer server.Close()
+	configs := make(chan *PushConfig, 1)
+	server.Handle(TypeConfig, func(message DataSaver) error {
+		configs <- message.(*PushConfig)
+		return nil
+	})
+	go func() {
+		client.Write([]byte("packet1"))
+		client.Send(TypeConfig, &PushConfig{MTU: 1400})
+		client.Write([]byte("packet2"))
+		client.Disconnect("bye")
+	}()
+	buf := make([]byte, 4096)
+	for _, expect := range []string{"packet1", "packet2"} {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], []byte(expect)) {
+			t.Fatalf("packet should be %s, but got %s", expect, buf[:n])
+		}
+	}
+	if config := <-configs; config.MTU != 1400 {
+		t.Fatalf("mtu should be 1400, but got %d", config.MTU)
+	}
+	if _, err := server.Read(buf); err == nil || !strings.Contains(err.Error(), "bye") {
+		t.Fatalf("tunnel should be disconnected, but got %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewTunnel("client", c1)
+	server := NewTunnel("server", c2)
+	defer client.Close()
+	defer server.Close()
+	client.Timeout = time.Second
+	client.StartKeepalive(10 * time.Millisecond)
+	go server.Read(make([]byte, 4096))
+	go client.Read(make([]byte, 4096))
+	time.Sleep(100 * time.Millisecond)
+	if client.RTT() <= 0 {
+		t.Fatal("rtt should be measured")
+	}
+
+	// peer without keepalive is considered dead
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	tunnel := NewTunnel("tunnel", c3)
+	defer tunnel.Close()
+	tunnel.Timeout = 50 * time.Millisecond
+	if _, err := tunnel.Read(make([]byte, 4096)); err == nil || !strings.Contains(err.Error(), "dead") {
+		t.Fatalf("peer should be dead, but got %v", err)
+	}
+}
+
+func TestDisconnectDeadPeer(t *testing.T) {
+	// nothing is read from a pipe without reader, like a dead peer
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tunnel := NewTunnel("tunnel", c1)
+	start := time.Now()
+	if err := tunnel.Disconnect("bye"); err == nil {
+		t.Fatal("disconnect message should not be sent")
+	}
+	if elapsed := time.Since(start); elapsed > 2*disconnectTimeout {
+		t.Fatalf("disconnect should not block, but took %s", elapsed)
+	}
+	if _, err := tunnel.Write([]byte("packet")); err == nil {
+		t.Fatal("tunnel should be closed")
+	}
+}
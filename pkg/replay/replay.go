@@ -0,0 +1,69 @@
+package replay
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// record is a seen authentication
+type record struct {
+	key  string
+	time time.Time
+}
+
+// Cache records recently seen authentications and finds replayed ones.
+// It holds at most Capacity records and forgets records out of Window.
+type Cache struct {
+	sync.Mutex
+	// Window is the max clock skew between clients and server
+	Window time.Duration
+	// Capacity is the max count of records
+	Capacity int
+	records  map[string]*list.Element
+	order    *list.List
+}
+
+// NewCache creates a replay cache
+func NewCache(window time.Duration, capacity int) *Cache {
+	return &Cache{
+		Window:   window,
+		Capacity: capacity,
+		records:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// InWindow checks whether the timestamp is in clock skew window
+func (c *Cache) InWindow(timestamp uint32) bool {
+	skew := time.Since(time.Unix(int64(timestamp), 0))
+	return skew <= c.Window && skew >= -c.Window
+}
+
+// Check records an authentication and returns false if it has been seen
+func (c *Cache) Check(account string, timestamp uint32, key []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	// forget records out of window, they are rejected by InWindow
+	for e := c.order.Front(); e != nil && now.Sub(e.Value.(*record).time) > 2*c.Window; e = c.order.Front() {
+		c.remove(e)
+	}
+	id := fmt.Sprintf("%d/%x/%s", timestamp, key, account)
+	if _, ok := c.records[id]; ok {
+		return false
+	}
+	// forget the oldest records if cache is full
+	for c.order.Len() > 0 && c.order.Len() >= c.Capacity {
+		c.remove(c.order.Front())
+	}
+	c.records[id] = c.order.PushBack(&record{id, now})
+	return true
+}
+
+// remove removes a record from cache
+func (c *Cache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.records, e.Value.(*record).key)
+}
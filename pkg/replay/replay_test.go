@@ -0,0 +1,27 @@
+package replay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(time.Minute, 2)
+	now := uint32(time.Now().Unix())
+	if !c.InWindow(now) || c.InWindow(now-120) || c.InWindow(now+120) {
+		t.Fatal("window check failed")
+	}
+	key := []byte{1, 2, 3}
+	if !c.Check("alice", now, key) {
+		t.Fatal("first authentication should pass")
+	}
+	if c.Check("alice", now, key) {
+		t.Fatal("replayed authentication should fail")
+	}
+	if !c.Check("bob", now, key) || !c.Check("alice", now, []byte{4}) {
+		t.Fatal("different authentications should pass")
+	}
+	if c.order.Len() != 2 || len(c.records) != 2 {
+		t.Fatalf("cache should hold 2 records, but got %d", c.order.Len())
+	}
+}
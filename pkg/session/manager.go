@@ -0,0 +1,153 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/ipam"
+)
+
+// Manager manages sessions and routes packets to sessions by longest prefix
+// match. A session owns the host route of its tunnel ip and the subnets of
+// its account. It's safe for concurrent use.
+type Manager struct {
+	sync.RWMutex
+	// routes maps prefix length to routes of the length
+	routes [33]map[uint32]*Session
+}
+
+// NewManager creates a session manager
+func NewManager() *Manager {
+	m := &Manager{}
+	for i := range m.routes {
+		m.routes[i] = make(map[uint32]*Session)
+	}
+	return m
+}
+
+// networks returns the routes of a session with account
+func networks(s *Session, acc *account.Account) []*net.IPNet {
+	result := []*net.IPNet{{IP: s.Address.To4(), Mask: net.CIDRMask(32, 32)}}
+	return append(result, acc.Networks()...)
+}
+
+// key returns the prefix length and masked ip of a route
+func key(r *net.IPNet) (int, uint32) {
+	ones, _ := r.Mask.Size()
+	return ones, ipam.ConvertIPToInt(r.IP.To4().Mask(r.Mask))
+}
+
+// Add adds a session. It returns an error if the tunnel ip or subnets of
+// session have been used by another session.
+func (m *Manager) Add(s *Session) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.add(s, networks(s, s.Account())); err != nil {
+		return err
+	}
+	s.manager = m
+	return nil
+}
+
+// add adds routes of a session if none of them is used by another session
+func (m *Manager) add(s *Session, routes []*net.IPNet) error {
+	for _, r := range routes {
+		ones, value := key(r)
+		if old, ok := m.routes[ones][value]; ok && old != s {
+			return fmt.Errorf("route %s has been used by %s", r.String(), old.Name())
+		}
+	}
+	for _, r := range routes {
+		ones, value := key(r)
+		m.routes[ones][value] = s
+	}
+	return nil
+}
+
+// remove removes routes of a session
+func (m *Manager) remove(s *Session, routes []*net.IPNet) {
+	for _, r := range routes {
+		ones, value := key(r)
+		if m.routes[ones][value] == s {
+			delete(m.routes[ones], value)
+		}
+	}
+}
+
+// Update replaces the account of a session and routes of its subnets. The
+// session keeps its old account if the new subnets are used by another
+// session.
+func (m *Manager) Update(s *Session, acc *account.Account) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.routes[32][ipam.ConvertIPToInt(s.Address.To4())] != s {
+		return fmt.Errorf("%s is not in manager", s.Name())
+	}
+	old := networks(s, s.Account())
+	m.remove(s, old)
+	if err := m.add(s, networks(s, acc)); err != nil {
+		m.add(s, old)
+		return err
+	}
+	s.account.Store(acc)
+	return nil
+}
+
+// Get returns the session of a tunnel ip
+func (m *Manager) Get(ip net.IP) (*Session, bool) {
+	ip = ip.To4()
+	if ip == nil {
+		return nil, false
+	}
+	m.RLock()
+	defer m.RUnlock()
+	s, ok := m.routes[32][ipam.ConvertIPToInt(ip)]
+	return s, ok
+}
+
+// Lookup returns the session which has the longest route matching ip
+func (m *Manager) Lookup(ip net.IP) (*Session, bool) {
+	ip = ip.To4()
+	if ip == nil {
+		return nil, false
+	}
+	value := ipam.ConvertIPToInt(ip)
+	m.RLock()
+	defer m.RUnlock()
+	for ones := 32; ones >= 0; ones-- {
+		if len(m.routes[ones]) == 0 {
+			continue
+		}
+		mask := uint32(0)
+		if ones > 0 {
+			mask = ^uint32(0) << uint(32-ones)
+		}
+		if s, ok := m.routes[ones][value&mask]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Remove removes a session. It does nothing if the session is not in manager.
+func (m *Manager) Remove(s *Session) {
+	m.Lock()
+	defer m.Unlock()
+	m.remove(s, networks(s, s.Account()))
+}
+
+// List returns all sessions
+func (m *Manager) List() []*Session {
+	m.RLock()
+	defer m.RUnlock()
+	result := make([]*Session, 0, len(m.routes[32]))
+	for value, s := range m.routes[32] {
+		// skip host routes of subnets
+		if ipam.ConvertIPToInt(s.Address.To4()) == value {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+package session
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/proto"
+)
+
+// Stats contains counters of a session
+type Stats struct {
+	// RxPackets is the count of packets received from client
+	RxPackets uint64 `json:"rxPackets"`
+	// RxBytes is the count of bytes received from client
+	RxBytes uint64 `json:"rxBytes"`
+	// TxPackets is the count of packets sent to client
+	TxPackets uint64 `json:"txPackets"`
+	// TxBytes is the count of bytes sent to client
+	TxBytes uint64 `json:"txBytes"`
+	// Dropped is the count of packets dropped by server
+	Dropped uint64 `json:"dropped"`
+}
+
+// queueLength is the max count of packets waiting to be sent to client
+const queueLength = 256
+
+// Session is a connected client on server
+type Session struct {
+	// stats is accessed atomically, so it must be 64-bit aligned on 32-bit
+	// platforms by being at the top
+	stats Stats
+	// Address is the tunnel ip of client
+	Address net.IP
+	// RemoteAddr is the address of client
+	RemoteAddr net.Addr
+	// StartTime is the time when session is created
+	StartTime time.Time
+	// Tunnel is the tunnel between client and server
+	Tunnel *proto.Tunnel
+	// Release is called once after session closed, e.g. to release the
+	// tunnel ip. It's optional.
+	Release func()
+
+	account atomic.Value
+	manager *Manager
+	queue   chan []byte
+	once    sync.Once
+	closed  chan struct{}
+}
+
+// NewSession creates a session
+func NewSession(acc *account.Account, address net.IP, remoteAddr net.Addr, tunnel *proto.Tunnel) *Session {
+	s := &Session{
+		Address:    address,
+		RemoteAddr: remoteAddr,
+		StartTime:  time.Now(),
+		Tunnel:     tunnel,
+		queue:      make(chan []byte, queueLength),
+		closed:     make(chan struct{}),
+	}
+	s.account.Store(acc)
+	go s.send()
+	return s
+}
+
+// Account returns the account of client. The account may be replaced by
+// Manager.Update when accounts are reloaded.
+func (s *Session) Account() *account.Account {
+	return s.account.Load().(*account.Account)
+}
+
+// Name returns a readable name for logging
+func (s *Session) Name() string {
+	return s.Account().Name + "@" + s.RemoteAddr.String()
+}
+
+// Read reads an ip packet from client
+func (s *Session) Read(p []byte) (int, error) {
+	n, err := s.Tunnel.Read(p)
+	if err == nil {
+		atomic.AddUint64(&s.stats.RxPackets, 1)
+		atomic.AddUint64(&s.stats.RxBytes, uint64(n))
+	}
+	return n, err
+}
+
+// Write writes an ip packet to client
+func (s *Session) Write(p []byte) (int, error) {
+	n, err := s.Tunnel.Write(p)
+	if err == nil {
+		atomic.AddUint64(&s.stats.TxPackets, 1)
+		atomic.AddUint64(&s.stats.TxBytes, uint64(n))
+	}
+	return n, err
+}
+
+// Enqueue queues an ip packet to client without blocking, and packet must
+// not be modified after that. The packet is dropped if the queue is full,
+// so a client which can't receive packets doesn't block others.
+func (s *Session) Enqueue(packet []byte) {
+	select {
+	case s.queue <- packet:
+	default:
+		s.Drop()
+	}
+}
+
+// send writes queued packets to client until session closed. Session is
+// closed if writing failed.
+func (s *Session) send() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case packet := <-s.queue:
+			if _, err := s.Write(packet); err != nil {
+				s.Close("")
+				return
+			}
+		}
+	}
+}
+
+// Drop records a dropped packet
+func (s *Session) Drop() {
+	atomic.AddUint64(&s.stats.Dropped, 1)
+}
+
+// Stats returns a snapshot of counters
+func (s *Session) Stats() Stats {
+	return Stats{
+		RxPackets: atomic.LoadUint64(&s.stats.RxPackets),
+		RxBytes:   atomic.LoadUint64(&s.stats.RxBytes),
+		TxPackets: atomic.LoadUint64(&s.stats.TxPackets),
+		TxBytes:   atomic.LoadUint64(&s.stats.TxBytes),
+		Dropped:   atomic.LoadUint64(&s.stats.Dropped),
+	}
+}
+
+// Close removes session from its manager, closes the tunnel and calls
+// Release. Client is notified if reason is not empty, and the notification
+// is given up if client is dead. It's safe to close a session many times,
+// and Close returns after the session is closed.
+func (s *Session) Close(reason string) error {
+	var err error
+	s.once.Do(func() {
+		if s.manager != nil {
+			s.manager.Remove(s)
+		}
+		if reason != "" {
+			err = s.Tunnel.Disconnect(reason)
+		} else {
+			err = s.Tunnel.Close()
+		}
+		if s.Release != nil {
+			s.Release()
+		}
+		close(s.closed)
+	})
+	return err
+}
+
+// Closed returns a channel which is closed after session closed
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
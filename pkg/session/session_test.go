@@ -0,0 +1,158 @@
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kdada/tinyvpn/pkg/account"
+	"github.com/kdada/tinyvpn/pkg/proto"
+)
+
+func newTestSession(address string, subnets ...string) (*Session, net.Conn) {
+	c1, c2 := net.Pipe()
+	acc := &account.Account{Name: "alice", SecretKey: "a", Subnets: subnets}
+	acc.Validate()
+	return NewSession(acc, net.ParseIP(address), c1.RemoteAddr(), proto.NewTunnel("test", c1)), c2
+}
+
+func TestManager(t *testing.T) {
+	m := NewManager()
+	s1, c1 := newTestSession("10.0.0.2")
+	defer c1.Close()
+	s2, c2 := newTestSession("10.0.0.2")
+	defer c2.Close()
+	if err := m.Add(s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(s2); err == nil {
+		t.Fatal("session with used address should not be added")
+	}
+	if s, ok := m.Get(net.ParseIP("10.0.0.2")); !ok || s != s1 {
+		t.Fatal("session should be found")
+	}
+	// removing another session does nothing
+	m.Remove(s2)
+	if len(m.List()) != 1 {
+		t.Fatal("manager should have 1 session")
+	}
+	s1.Close("")
+	s1.Close("")
+	if _, ok := m.Get(net.ParseIP("10.0.0.2")); ok {
+		t.Fatal("closed session should be removed")
+	}
+	select {
+	case <-s1.Closed():
+	default:
+		t.Fatal("session should be closed")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	m := NewManager()
+	s1, c1 := newTestSession("10.0.0.2", "192.168.0.0/16")
+	defer c1.Close()
+	s2, c2 := newTestSession("10.0.0.3", "192.168.1.0/24", "192.168.2.1/32")
+	defer c2.Close()
+	s3, c3 := newTestSession("10.0.0.4", "192.168.1.0/24")
+	defer c3.Close()
+	if err := m.Add(s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(s2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(s3); err == nil {
+		t.Fatal("session with used subnet should not be added")
+	}
+	cases := map[string]*Session{
+		"10.0.0.2":    s1,
+		"10.0.0.3":    s2,
+		"192.168.3.1": s1,
+		"192.168.1.1": s2,
+		"192.168.2.1": s2,
+		"192.168.2.2": s1,
+		"10.0.0.4":    nil,
+	}
+	for ip, expect := range cases {
+		s, ok := m.Lookup(net.ParseIP(ip))
+		if ok != (expect != nil) || s != expect {
+			t.Fatalf("unexpected session for %s", ip)
+		}
+	}
+	if len(m.List()) != 2 {
+		t.Fatalf("manager should have 2 sessions, but got %d", len(m.List()))
+	}
+	s2.Close("")
+	if s, ok := m.Lookup(net.ParseIP("192.168.1.1")); !ok || s != s1 {
+		t.Fatal("192.168.1.1 should be routed to s1 after s2 closed")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := NewManager()
+	s1, c1 := newTestSession("10.0.0.2", "192.168.1.0/24")
+	defer c1.Close()
+	s2, c2 := newTestSession("10.0.0.3", "192.168.2.0/24")
+	defer c2.Close()
+	if err := m.Add(s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(s2); err != nil {
+		t.Fatal(err)
+	}
+	acc := &account.Account{Name: "alice", SecretKey: "a", Subnets: []string{"192.168.3.0/24"}}
+	acc.Validate()
+	if err := m.Update(s1, acc); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := m.Lookup(net.ParseIP("192.168.3.1")); !ok || s != s1 || s1.Account() != acc {
+		t.Fatal("192.168.3.1 should be routed to s1 after updated")
+	}
+	if _, ok := m.Lookup(net.ParseIP("192.168.1.1")); ok {
+		t.Fatal("old subnet of s1 should be removed")
+	}
+	conflict := &account.Account{Name: "alice", SecretKey: "a", Subnets: []string{"192.168.2.0/24"}}
+	conflict.Validate()
+	if err := m.Update(s1, conflict); err == nil || s1.Account() != acc {
+		t.Fatal("s1 should keep its account if subnets conflict")
+	}
+	if s, ok := m.Lookup(net.ParseIP("192.168.3.1")); !ok || s != s1 {
+		t.Fatal("routes of s1 should be kept if subnets conflict")
+	}
+	s1.Close("")
+	if err := m.Update(s1, acc); err == nil {
+		t.Fatal("closed session should not be updated")
+	}
+}
+
+func TestDeadClient(t *testing.T) {
+	// nothing is read from the pipe, like a dead client
+	s, c := newTestSession("10.0.0.2")
+	defer c.Close()
+	released := make(chan struct{})
+	s.Release = func() {
+		close(released)
+	}
+	for i := 0; i < queueLength*2; i++ {
+		s.Enqueue([]byte("packet"))
+	}
+	if s.Stats().Dropped == 0 {
+		t.Fatal("packets should be dropped if the queue is full")
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Close("bye")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing a dead client should not block")
+	}
+	select {
+	case <-released:
+	default:
+		t.Fatal("session should be released")
+	}
+}
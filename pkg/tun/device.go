@@ -1,10 +1,15 @@
 package tun
 
 import (
+	"fmt"
 	"io"
 	"net"
 )
 
+// MaxMTU is the max mtu of devices. Packets are read into 4096 byte buffers
+// which also hold the headers of devices.
+const MaxMTU = 4000
+
 // Device describes an tunnel device. Read/Write one ip packet at once.
 type Device struct {
 	io.ReadWriteCloser
@@ -16,10 +21,14 @@ type Device struct {
 	DestIP net.IP
 	// Routes contains all routes via the device
 	Routes []*net.IPNet
+	// MTU is the mtu of device. It's 0 if the mtu is not set by SetMTU.
+	MTU int
 	// addRoute add a route to system route table
 	addRoute func(r *net.IPNet) error
 	// deleteRoute delete a route from system route table
 	deleteRoute func(r *net.IPNet) error
+	// setMTU sets the mtu of device
+	setMTU func(mtu int) error
 }
 
 // AddRoute adds route for device
@@ -32,6 +41,34 @@ func (d *Device) AddRoute(r *net.IPNet) error {
 	return nil
 }
 
+// DeleteRoute deletes a route added by AddRoute
+func (d *Device) DeleteRoute(r *net.IPNet) error {
+	for i, route := range d.Routes {
+		if route.String() != r.String() {
+			continue
+		}
+		if err := d.deleteRoute(route); err != nil {
+			return err
+		}
+		d.Routes = append(d.Routes[:i], d.Routes[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("route %s is not found in device %s", r.String(), d.Name)
+}
+
+// SetMTU sets the mtu of device
+func (d *Device) SetMTU(mtu int) error {
+	if mtu > MaxMTU {
+		return fmt.Errorf("mtu %d is larger than %d", mtu, MaxMTU)
+	}
+	err := d.setMTU(mtu)
+	if err != nil {
+		return err
+	}
+	d.MTU = mtu
+	return nil
+}
+
 // ClearRoutes clears all routes
 func (d *Device) ClearRoutes() error {
 	for i, r := range d.Routes {
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"os/exec"
+	"strconv"
 
 	"github.com/songgao/water"
 )
@@ -33,6 +34,9 @@ func CreateDevice(srcIP net.IP, destIP net.IP) (*Device, error) {
 			return addRoute(devName, ip)
 		},
 		deleteRoute: deleteRoute,
+		setMTU: func(mtu int) error {
+			return setMTU(devName, mtu)
+		},
 	}
 	return dev, nil
 }
@@ -49,6 +53,12 @@ func addRoute(devName string, ip *net.IPNet) error {
 	return cmd.Run()
 }
 
+// setMTU sets the mtu of specified device
+func setMTU(devName string, mtu int) error {
+	cmd := exec.Command("ifconfig", devName, "mtu", strconv.Itoa(mtu))
+	return cmd.Run()
+}
+
 // deleteRoute deletes route from specified device
 func deleteRoute(ip *net.IPNet) error {
 	cmd := exec.Command("route", "delete", ip.String())
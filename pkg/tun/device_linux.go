@@ -5,6 +5,7 @@ package tun
 import (
 	"net"
 	"os/exec"
+	"strconv"
 
 	"github.com/songgao/water"
 )
@@ -32,6 +33,9 @@ func CreateDevice(srcIP net.IP, destIP net.IP) (*Device, error) {
 			return addRoute(devName, r)
 		},
 		deleteRoute: deleteRoute,
+		setMTU: func(mtu int) error {
+			return setMTU(devName, mtu)
+		},
 	}
 	return dev, nil
 }
@@ -53,6 +57,12 @@ func addRoute(devName string, r *net.IPNet) error {
 	return cmd.Run()
 }
 
+// setMTU sets the mtu of specified device
+func setMTU(devName string, mtu int) error {
+	cmd := exec.Command("ip", "link", "set", devName, "mtu", strconv.Itoa(mtu))
+	return cmd.Run()
+}
+
 // deleteRoute deletes route from specified device
 func deleteRoute(r *net.IPNet) error {
 	cmd := exec.Command("ip", "r", "delete", r.String())
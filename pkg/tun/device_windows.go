@@ -44,6 +44,9 @@ func CreateDevice(srcIP net.IP, destIP net.IP) (*Device, error) {
 			return addRoute(index, destIP, r)
 		},
 		deleteRoute: deleteRoute,
+		setMTU: func(mtu int) error {
+			return setMTU(devName, mtu)
+		},
 	}
 	return dev, nil
 }
@@ -97,6 +100,12 @@ func addRoute(index string, ip net.IP, r *net.IPNet) error {
 	return cmd.Run()
 }
 
+// setMTU sets the mtu of specified device
+func setMTU(devName string, mtu int) error {
+	cmd := exec.Command("netsh", "interface", "ipv4", "set", "subinterface", devName, "mtu="+strconv.Itoa(mtu), "store=active")
+	return cmd.Run()
+}
+
 // deleteRoute deletes route from specified device
 func deleteRoute(r *net.IPNet) error {
 	cmd := exec.Command("route", "delete", r.String())
@@ -0,0 +1,20 @@
+package tun
+
+import "net"
+
+// Gateway is the next hop to a destination in system route table. Routes
+// via the original gateway keep packets to vpn server out of the tunnel.
+type Gateway struct {
+	// IP is the ip of gateway. It's nil if the destination is on link.
+	IP net.IP
+	// Device is the device to the gateway. It's the interface address on windows.
+	Device string
+}
+
+// String returns the gateway like "192.168.1.1 dev eth0"
+func (g *Gateway) String() string {
+	if g.IP == nil {
+		return "dev " + g.Device
+	}
+	return g.IP.String() + " dev " + g.Device
+}
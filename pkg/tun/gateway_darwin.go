@@ -0,0 +1,55 @@
+// +build darwin
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// LookupGateway returns the gateway which system uses to reach ip
+func LookupGateway(ip net.IP) (*Gateway, error) {
+	cmd := exec.Command("route", "-n", "get", ip.String())
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	// e.g.
+	//     gateway: 192.168.1.1
+	//   interface: en0
+	gateway := &Gateway{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "gateway:":
+			gateway.IP = net.ParseIP(fields[1])
+		case "interface:":
+			gateway.Device = fields[1]
+		}
+	}
+	if gateway.Device == "" {
+		return nil, fmt.Errorf("can't find gateway of %s", ip.String())
+	}
+	return gateway, nil
+}
+
+// AddHostRoute adds a route of ip via gateway. It replaces the old one.
+func AddHostRoute(ip net.IP, gateway *Gateway) error {
+	DeleteHostRoute(ip)
+	cmd := exec.Command("route", "-n", "add", "-host", ip.String(), "-interface", gateway.Device)
+	if gateway.IP != nil {
+		cmd = exec.Command("route", "-n", "add", "-host", ip.String(), gateway.IP.String())
+	}
+	return cmd.Run()
+}
+
+// DeleteHostRoute deletes the route of ip
+func DeleteHostRoute(ip net.IP) error {
+	cmd := exec.Command("route", "-n", "delete", "-host", ip.String())
+	return cmd.Run()
+}
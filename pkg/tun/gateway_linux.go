@@ -0,0 +1,51 @@
+// +build linux
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// LookupGateway returns the gateway which system uses to reach ip
+func LookupGateway(ip net.IP) (*Gateway, error) {
+	cmd := exec.Command("ip", "route", "get", ip.String())
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	// e.g. 8.8.8.8 via 192.168.1.1 dev eth0 src 192.168.1.5 uid 0
+	gateway := &Gateway{}
+	fields := strings.Fields(string(output))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			gateway.IP = net.ParseIP(fields[i+1])
+		case "dev":
+			gateway.Device = fields[i+1]
+		}
+	}
+	if gateway.Device == "" {
+		return nil, fmt.Errorf("can't find gateway of %s", ip.String())
+	}
+	return gateway, nil
+}
+
+// AddHostRoute adds a route of ip via gateway. It replaces the old one.
+func AddHostRoute(ip net.IP, gateway *Gateway) error {
+	args := []string{"route", "replace", ip.String() + "/32"}
+	if gateway.IP != nil {
+		args = append(args, "via", gateway.IP.String())
+	}
+	args = append(args, "dev", gateway.Device)
+	cmd := exec.Command("ip", args...)
+	return cmd.Run()
+}
+
+// DeleteHostRoute deletes the route of ip
+func DeleteHostRoute(ip net.IP) error {
+	cmd := exec.Command("ip", "route", "delete", ip.String()+"/32")
+	return cmd.Run()
+}
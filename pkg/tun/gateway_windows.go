@@ -0,0 +1,55 @@
+// +build windows
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// defaultRouteRegexp matches default routes in route print, e.g.
+//     0.0.0.0          0.0.0.0      192.168.1.1    192.168.1.5     25
+var defaultRouteRegexp = regexp.MustCompile(`(?m)^\s*0\.0\.0\.0\s+0\.0\.0\.0\s+(\S+)\s+(\S+)\s+(\d+)\s*$`)
+
+// LookupGateway returns the gateway which system uses to reach ip. It
+// returns the default gateway with the lowest metric.
+func LookupGateway(ip net.IP) (*Gateway, error) {
+	cmd := exec.Command("route", "print", "-4", "0.0.0.0")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var gateway *Gateway
+	metric := -1
+	for _, strs := range defaultRouteRegexp.FindAllStringSubmatch(string(output), -1) {
+		m, err := strconv.Atoi(strs[3])
+		if err != nil || (metric >= 0 && m >= metric) {
+			continue
+		}
+		metric = m
+		gateway = &Gateway{IP: net.ParseIP(strs[1]), Device: strs[2]}
+	}
+	if gateway == nil {
+		return nil, fmt.Errorf("can't find gateway of %s", ip.String())
+	}
+	return gateway, nil
+}
+
+// AddHostRoute adds a route of ip via gateway. It replaces the old one.
+func AddHostRoute(ip net.IP, gateway *Gateway) error {
+	if gateway.IP == nil {
+		return fmt.Errorf("gateway of %s is on link", ip.String())
+	}
+	DeleteHostRoute(ip)
+	cmd := exec.Command("route", "add", ip.String(), "mask", "255.255.255.255", gateway.IP.String())
+	return cmd.Run()
+}
+
+// DeleteHostRoute deletes the route of ip
+func DeleteHostRoute(ip net.IP) error {
+	cmd := exec.Command("route", "delete", ip.String())
+	return cmd.Run()
+}